@@ -0,0 +1,143 @@
+package mgots
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// An Upsert is a single update operation that is applied to the set matching
+// the query. The set is created from the query if it does not exist yet. If a
+// pipeline is specified it is used instead of the update.
+type Upsert struct {
+	Query    bson.M
+	Update   bson.M
+	Pipeline []bson.M
+}
+
+func (u Upsert) update() interface{} {
+	// prefer pipeline
+	if u.Pipeline != nil {
+		return u.Pipeline
+	}
+
+	return u.Update
+}
+
+// A Query describes the sets and samples that should be aggregated.
+type Query struct {
+	// The first and last set timestamp (inclusive).
+	FirstSet time.Time
+	LastSet  time.Time
+
+	// The first and last sample timestamp (inclusive). Only used when
+	// aggregating samples.
+	FirstSample time.Time
+	LastSample  time.Time
+
+	// The metrics that should be aggregated.
+	Metrics []string
+
+	// The tags that must match.
+	Tags bson.M
+
+	// The width of the buckets in which samples should be grouped. The
+	// buckets are aligned to the Unix epoch and identified by their start.
+	// Only used when aggregating samples.
+	Step time.Duration
+
+	// The location in which buckets are aligned to the start of the day
+	// instead of the Unix epoch. Steps of a day or longer yield calendar days.
+	Location *time.Location
+
+	// The tag keys by which samples should be grouped in addition to their
+	// start. The values of the keys are returned as the tags of the samples.
+	GroupBy []string
+
+	// Whether the aggregation may use temporary files and the number of
+	// samples fetched per batch. Zero uses the default batch size.
+	AllowDiskUse bool
+	BatchSize    int
+
+	// The tags of series that must not match. A set is excluded if it matches
+	// all tags of one of the entries.
+	Exclude []bson.M
+}
+
+// An Iterator yields aggregated samples one by one.
+type Iterator interface {
+	// Next should decode the next sample and return whether one was
+	// available.
+	Next(sample *Sample) bool
+
+	// Err should return the error that stopped the iteration.
+	Err() error
+
+	// Close should release the iterator and return any error.
+	Close() error
+}
+
+// A Backend stores the sets of a Collection. All operations should honor the
+// deadline of the specified context and its cancellation as far as the
+// underlying driver allows. The context error should be returned if the
+// operation has been aborted due to the context.
+type Backend interface {
+	// Upsert should apply all specified upsert operations.
+	Upsert(ctx context.Context, upserts []Upsert) error
+
+	// AggregateSamples should aggregate all samples that match the query and
+	// return them sorted by their start.
+	AggregateSamples(ctx context.Context, query Query) ([]Sample, error)
+
+	// AggregateSets should aggregate the set level metrics of all sets that
+	// match the query and return them sorted by their start.
+	AggregateSets(ctx context.Context, query Query) ([]Sample, error)
+
+	// IterateSamples should return an iterator that yields the samples that
+	// AggregateSamples would return.
+	IterateSamples(ctx context.Context, query Query) (Iterator, error)
+
+	// IterateSets should return an iterator that yields the samples that
+	// AggregateSets would return.
+	IterateSets(ctx context.Context, query Query) (Iterator, error)
+
+	// Starts should return the distinct starts of the most recent sets that
+	// match the query and contain at least one of the metrics. The starts
+	// should be sorted in descending order and limited to the specified
+	// number.
+	Starts(ctx context.Context, query Query, limit int) ([]time.Time, error)
+
+	// Metrics should return the names of all metrics stored in the sets that
+	// match the query. The list is not required to be sorted.
+	Metrics(ctx context.Context, query Query) ([]string, error)
+
+	// Series should return the tags of all series that have sets matching the
+	// query. The list is not required to be sorted.
+	Series(ctx context.Context, query Query) ([]bson.M, error)
+
+	// TagKeys should return the distinct tag keys of all sets that match the
+	// query. The list is not required to be sorted.
+	TagKeys(ctx context.Context, query Query) ([]string, error)
+
+	// TagValues should return the distinct values of the specified tag key of
+	// all sets that match the query. The list is not required to be sorted.
+	TagValues(ctx context.Context, query Query, key string) ([]interface{}, error)
+
+	// Update should apply the pipeline to all sets that match the query.
+	Update(ctx context.Context, query Query, pipeline []bson.M) error
+
+	// Remove should remove all sets that match the query and return the
+	// number of removed sets.
+	Remove(ctx context.Context, query Query) (int, error)
+
+	// MigrateSeries should set the series identifier returned by the function
+	// for the tags of a set on all sets that lack it and return the number of
+	// updated sets.
+	MigrateSeries(ctx context.Context, id func(tags bson.M) string) (int, error)
+
+	// EnsureIndexes should ensure that the necessary indexes have been
+	// created. If removeAfter is specified, sets should be automatically
+	// removed when their start falls behind the specified duration.
+	EnsureIndexes(ctx context.Context, removeAfter time.Duration) error
+}
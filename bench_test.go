@@ -6,6 +6,8 @@ import (
 )
 
 func BenchmarkCollectionInsert(b *testing.B) {
+	requireMongo(b)
+
 	b.ReportAllocs()
 
 	coll := Wrap(db.C("bench-coll-insert"), OneMinuteOf60Seconds)
@@ -28,6 +30,8 @@ func BenchmarkCollectionInsert(b *testing.B) {
 }
 
 func BenchmarkCollectionBulkInsert(b *testing.B) {
+	requireMongo(b)
+
 	b.ReportAllocs()
 
 	coll := Wrap(db.C("bench-coll-bulk-insert"), OneMinuteOf60Seconds)
@@ -58,6 +62,8 @@ func BenchmarkCollectionBulkInsert(b *testing.B) {
 }
 
 func BenchmarkCollectionBulkInsert1000(b *testing.B) {
+	requireMongo(b)
+
 	b.ReportAllocs()
 
 	coll := Wrap(db.C("bench-coll-bulk-insert-1000"), OneMinuteOf60Seconds)
@@ -88,6 +94,8 @@ func BenchmarkCollectionBulkInsert1000(b *testing.B) {
 }
 
 func BenchmarkCollectionAggregateSamples(b *testing.B) {
+	requireMongo(b)
+
 	b.ReportAllocs()
 
 	coll := Wrap(db.C("bench-coll-aggregate-samples"), OneMinuteOf60Seconds)
@@ -132,6 +140,8 @@ func BenchmarkCollectionAggregateSamples(b *testing.B) {
 }
 
 func BenchmarkCollectionAggregateSets(b *testing.B) {
+	requireMongo(b)
+
 	b.ReportAllocs()
 
 	coll := Wrap(db.C("bench-coll-aggregate-sets"), OneMinuteOf60Seconds)
@@ -3,72 +3,380 @@
 package mgots
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
 
+// ErrInvalidStep is returned if a step is not a positive whole number of
+// milliseconds or if a step aligned in a location neither evenly divides a day
+// nor is a whole number of days.
+var ErrInvalidStep = errors.New("mgots: invalid step")
+
+// ErrInvalidLocation is returned if a location used to align steps cannot be
+// loaded by its name, which is the case for time.Local and fixed zones.
+var ErrInvalidLocation = errors.New("mgots: invalid location")
+
+type bulkSample struct {
+	start   time.Time
+	key     string
+	tags    bson.M
+	metrics map[string]Metric
+	gauges  map[string]Point
+}
+
 // A Bulk represents an operation that can be used to add multiple metrics at
-// once. It is a wrapper around the mgo.Bulk type.
+// once. Values for the same tags and sample are merged locally and written
+// using a single upsert.
 type Bulk struct {
-	coll *Collection
-	bulk *mgo.Bulk
+	coll     *Collection
+	index    map[string]*bulkSample
+	samples  []*bulkSample
+	counters map[string]counterState
 }
 
 // Insert will queue the insert in the bulk operation.
 func (b *Bulk) Insert(timestamp time.Time, metrics map[string]float64, tags bson.M) {
-	b.bulk.Upsert(b.coll.upsertSample(timestamp, metrics, tags))
+	// get sample
+	sample := b.sample(timestamp, tags)
+
+	// merge metrics
+	for name, value := range metrics {
+		metric := newMetric(Point{Time: timestamp, Value: value})
+		if b.coll.sketches[name] {
+			metric.Sketch = newSketch(value)
+		}
+
+		if existing, ok := sample.metrics[name]; ok {
+			metric = existing.merge(metric)
+		}
+
+		sample.metrics[name] = metric
+	}
+}
+
+// InsertDistinct will queue the insert of the specified distinct values in the
+// bulk operation.
+func (b *Bulk) InsertDistinct(timestamp time.Time, values map[string][]string, tags bson.M) {
+	// get sample
+	sample := b.sample(timestamp, tags)
+
+	// merge values
+	for name, list := range values {
+		metric := sample.metrics[name]
+		metric.HLL = metric.HLL.merge(newHyperLogLog(list))
+		sample.metrics[name] = metric
+	}
+}
+
+// InsertCounter will queue the insert of the increases of the specified
+// monotonic counters in the bulk operation. See Collection.InsertCounter for
+// details.
+func (b *Bulk) InsertCounter(timestamp time.Time, counters map[string]float64, tags bson.M) {
+	// get increases
+	increases := b.coll.counterIncreases(b.counters, timestamp, counters, tags)
+	if len(increases) == 0 {
+		return
+	}
+
+	// insert increases
+	b.Insert(timestamp, increases, tags)
+}
+
+// InsertGauge will queue the insert of the specified gauges in the bulk
+// operation. See Collection.InsertGauge for details.
+func (b *Bulk) InsertGauge(timestamp time.Time, gauges map[string]float64, tags bson.M) {
+	// get sample
+	sample := b.sample(timestamp, tags)
+
+	// keep latest values
+	for name, value := range gauges {
+		sample.gauges[name] = lastPoint(sample.gauges[name], Point{Time: timestamp, Value: value})
+	}
 }
 
 // Run will insert all queued insert operations.
 func (b *Bulk) Run() error {
-	_, err := b.bulk.Run()
-	return err
+	return b.RunContext(context.Background())
+}
+
+// RunContext will insert all queued insert operations like Run but abort when
+// the deadline of the context is exceeded or, if supported by the backend, when
+// the context is cancelled. The context error is returned in that case.
+func (b *Bulk) RunContext(ctx context.Context) error {
+	// run upserts
+	err := b.coll.backend.Upsert(ctx, b.upserts())
+	if err != nil {
+		return err
+	}
+
+	// keep counter observations once written
+	b.coll.updateCounters(b.counters)
+
+	return nil
 }
 
-// A Collection represents a time series enabled collection. It is a wrapper
-// around the mgo.Collection type.
+func (b *Bulk) sample(timestamp time.Time, tags bson.M) *bulkSample {
+	// get set start and sample key
+	start, key := b.coll.res.Split(timestamp)
+
+	// get identifier
+	id := strconv.FormatInt(start.UnixNano(), 10) + "/" + key + "/" + tagsKey(tags)
+
+	// get or add sample
+	sample, ok := b.index[id]
+	if !ok {
+		sample = &bulkSample{
+			start:   start,
+			key:     key,
+			tags:    tags,
+			metrics: map[string]Metric{},
+			gauges:  map[string]Point{},
+		}
+
+		b.index[id] = sample
+		b.samples = append(b.samples, sample)
+	}
+
+	return sample
+}
+
+func (b *Bulk) upserts() []Upsert {
+	// prepare upserts
+	upserts := make([]Upsert, 0, len(b.samples))
+
+	// add upserts
+	for _, sample := range b.samples {
+		if len(sample.metrics) > 0 || len(sample.gauges) == 0 {
+			upserts = append(upserts, b.coll.upsertSample(sample.start, sample.key, sample.metrics, sample.tags))
+		}
+
+		if len(sample.gauges) > 0 {
+			gauges := make(map[string]Metric, len(sample.gauges))
+			for name, point := range sample.gauges {
+				gauges[name] = newMetric(point)
+			}
+
+			upserts = append(upserts, b.coll.replaceSample(sample.start, sample.key, gauges, sample.tags))
+		}
+	}
+
+	return upserts
+}
+
+// A Collection represents a time series enabled collection. It stores its
+// sets using a Backend.
 type Collection struct {
-	coll *mgo.Collection
-	res  Resolution
+	backend  Backend
+	res      Resolution
+	sketches map[string]bool
+
+	counters      map[string]counterState
+	countersMutex sync.Mutex
+}
+
+type counterState struct {
+	time  time.Time
+	value float64
 }
 
 // Wrap will take a mgo.Collection and return a Collection.
+//
+// Note: The mgo driver cannot interrupt running operations. The context of an
+// operation is therefore only checked before the operation is started and
+// between the samples yielded by a cursor. Deadlines are enforced as the
+// maximum execution time of aggregations and as socket timeouts of all other
+// operations. Use WrapDriver to also interrupt running operations on
+// cancellation.
 func Wrap(coll *mgo.Collection, res Resolution) *Collection {
+	return WrapBackend(&mgoBackend{coll: coll}, res)
+}
+
+// WrapBackend will take a Backend and return a Collection.
+func WrapBackend(backend Backend, res Resolution) *Collection {
 	return &Collection{
-		coll: coll,
-		res:  res,
+		backend:  backend,
+		res:      res,
+		sketches: map[string]bool{},
+		counters: map[string]counterState{},
+	}
+}
+
+// EnableSketches will enable quantile sketches for the specified metrics.
+// Sketches require additional storage and should only be enabled for metrics
+// that need quantiles. It must be called before any inserts.
+func (c *Collection) EnableSketches(metrics ...string) {
+	for _, name := range metrics {
+		c.sketches[name] = true
 	}
 }
 
 // Insert will immediately write the specified metrics to the collection.
 func (c *Collection) Insert(timestamp time.Time, metrics map[string]float64, tags bson.M) error {
-	_, err := c.coll.Upsert(c.upsertSample(timestamp, metrics, tags))
-	return err
+	return c.InsertContext(context.Background(), timestamp, metrics, tags)
 }
 
-// Bulk will return a new bulk operation.
-func (c *Collection) Bulk() *Bulk {
-	// create new bulk operation
-	bulk := c.coll.Bulk()
-	bulk.Unordered()
+// InsertContext will immediately write the specified metrics like Insert but
+// use the specified context like Bulk.RunContext.
+func (c *Collection) InsertContext(ctx context.Context, timestamp time.Time, metrics map[string]float64, tags bson.M) error {
+	// prepare bulk
+	bulk := c.Bulk()
+	bulk.Insert(timestamp, metrics, tags)
+
+	return bulk.RunContext(ctx)
+}
+
+// InsertDistinct will immediately write the specified distinct values to the
+// collection. The values are counted using a HyperLogLog per metric which
+// allows estimating the number of distinct values per sample and range.
+func (c *Collection) InsertDistinct(timestamp time.Time, values map[string][]string, tags bson.M) error {
+	return c.InsertDistinctContext(context.Background(), timestamp, values, tags)
+}
+
+// InsertDistinctContext will immediately write the specified distinct values
+// like InsertDistinct but use the specified context like Bulk.RunContext.
+func (c *Collection) InsertDistinctContext(ctx context.Context, timestamp time.Time, values map[string][]string, tags bson.M) error {
+	// prepare bulk
+	bulk := c.Bulk()
+	bulk.InsertDistinct(timestamp, values, tags)
+
+	return bulk.RunContext(ctx)
+}
+
+// InsertCounter will immediately write the increases of the specified
+// monotonic counters to the collection. The increase is calculated from the
+// previous observation of the same counter and series. A counter that is
+// smaller than its previous observation is treated as reset and its full value
+// is used as the increase. The first observation of a counter is only used as
+// baseline while observations that are not newer than the previous observation
+// are ignored. Observations only become the previous observation once they
+// have been written successfully, so the increase of a failed write is
+// included in the increase of the next observation.
+//
+// Note: The previous observations are kept in memory for every counter and
+// series that has been observed and are therefore lost when the process
+// restarts. Observations of the same counter and series should not be written
+// concurrently as they may be counted twice.
+func (c *Collection) InsertCounter(timestamp time.Time, counters map[string]float64, tags bson.M) error {
+	return c.InsertCounterContext(context.Background(), timestamp, counters, tags)
+}
+
+// InsertCounterContext will immediately write the increases of the specified
+// counters like InsertCounter but use the specified context like
+// Bulk.RunContext.
+func (c *Collection) InsertCounterContext(ctx context.Context, timestamp time.Time, counters map[string]float64, tags bson.M) error {
+	// prepare bulk
+	bulk := c.Bulk()
+	bulk.InsertCounter(timestamp, counters, tags)
+
+	return bulk.RunContext(ctx)
+}
+
+func (c *Collection) counterIncreases(pending map[string]counterState, timestamp time.Time, counters map[string]float64, tags bson.M) map[string]float64 {
+	// acquire mutex
+	c.countersMutex.Lock()
+	defer c.countersMutex.Unlock()
+
+	// get series key
+	series := tagsKey(tags)
+
+	// calculate increases
+	increases := make(map[string]float64, len(counters))
+	for name, value := range counters {
+		// get previous observation from the bulk or the collection
+		id := series + "/" + name
+		prev, ok := pending[id]
+		if !ok {
+			prev, ok = c.counters[id]
+		}
+		if ok && !timestamp.After(prev.time) {
+			continue
+		}
+
+		// queue observation
+		pending[id] = counterState{time: timestamp, value: value}
+
+		// skip first observation
+		if !ok {
+			continue
+		}
+
+		// handle counter resets
+		if value < prev.value {
+			increases[name] = value
+			continue
+		}
+
+		increases[name] = value - prev.value
+	}
+
+	return increases
+}
+
+func (c *Collection) updateCounters(observations map[string]counterState) {
+	// acquire mutex
+	c.countersMutex.Lock()
+	defer c.countersMutex.Unlock()
+
+	// keep newer observations
+	for id, state := range observations {
+		if prev, ok := c.counters[id]; !ok || state.time.After(prev.time) {
+			c.counters[id] = state
+		}
+	}
+}
 
-	return &Bulk{coll: c, bulk: bulk}
+// InsertGauge will immediately write the specified gauges to the collection.
+// Unlike with Insert, a gauge replaces the value of its sample instead of
+// being accumulated, which allows idempotent re-ingestion of snapshots. The set
+// level metrics of the gauges are recomputed from all samples in the set.
+//
+// Note: Gauges require MongoDB 4.2 or newer and should not be mixed with other
+// inserts or sketches for the same metric.
+func (c *Collection) InsertGauge(timestamp time.Time, gauges map[string]float64, tags bson.M) error {
+	return c.InsertGaugeContext(context.Background(), timestamp, gauges, tags)
 }
 
-func (c *Collection) upsertSample(t time.Time, metrics map[string]float64, tags bson.M) (bson.M, bson.M) {
-	// get set start and name key
-	start, key := c.res.Split(t)
+// InsertGaugeContext will immediately write the specified gauges like
+// InsertGauge but use the specified context like Bulk.RunContext.
+func (c *Collection) InsertGaugeContext(ctx context.Context, timestamp time.Time, gauges map[string]float64, tags bson.M) error {
+	// prepare bulk
+	bulk := c.Bulk()
+	bulk.InsertGauge(timestamp, gauges, tags)
 
+	return bulk.RunContext(ctx)
+}
+
+// Bulk will return a new bulk operation.
+func (c *Collection) Bulk() *Bulk {
+	return &Bulk{
+		coll:     c,
+		index:    map[string]*bulkSample{},
+		counters: map[string]counterState{},
+	}
+}
+
+func (c *Collection) upsertSample(start time.Time, key string, metrics map[string]Metric, tags bson.M) Upsert {
 	// prepare query
 	query := bson.M{
-		"start": start,
-		"tags":  tags,
+		"start":  start,
+		"series": SeriesID(tags),
 	}
 
 	// prepare update
 	update := bson.M{
+		"$setOnInsert": bson.M{
+			"tags": normalizeTags(tags),
+		},
 		"$set": bson.M{},
 		"$inc": bson.M{},
 		"$max": bson.M{},
@@ -76,100 +384,135 @@ func (c *Collection) upsertSample(t time.Time, metrics map[string]float64, tags
 	}
 
 	// add statements
-	for name, value := range metrics {
+	for name, metric := range metrics {
 		update["$set"].(bson.M)["samples."+key+".start"] = c.res.Join(start, key)
-		update["$inc"].(bson.M)["samples."+key+"."+name+".sum"] = value
-		update["$inc"].(bson.M)["samples."+key+"."+name+".num"] = 1
-		update["$max"].(bson.M)["samples."+key+"."+name+".max"] = value
-		update["$min"].(bson.M)["samples."+key+"."+name+".min"] = value
-		update["$inc"].(bson.M)["sum."+name] = value
-		update["$inc"].(bson.M)["num."+name] = 1
-		update["$max"].(bson.M)["max."+name] = value
-		update["$min"].(bson.M)["min."+name] = value
+
+		// add values
+		if metric.Num > 0 {
+			update["$inc"].(bson.M)["samples."+key+"."+name+".sum"] = metric.Sum
+			update["$inc"].(bson.M)["samples."+key+"."+name+".num"] = int(metric.Num)
+			update["$max"].(bson.M)["samples."+key+"."+name+".max"] = metric.Max
+			update["$min"].(bson.M)["samples."+key+"."+name+".min"] = metric.Min
+			update["$inc"].(bson.M)["samples."+key+"."+name+".sumsq"] = metric.SumSq
+			update["$min"].(bson.M)["samples."+key+"."+name+".first"] = pointDoc(metric.First)
+			update["$max"].(bson.M)["samples."+key+"."+name+".last"] = pointDoc(metric.Last)
+			update["$inc"].(bson.M)["sum."+name] = metric.Sum
+			update["$inc"].(bson.M)["num."+name] = int(metric.Num)
+			update["$max"].(bson.M)["max."+name] = metric.Max
+			update["$min"].(bson.M)["min."+name] = metric.Min
+			update["$inc"].(bson.M)["sumsq."+name] = metric.SumSq
+			update["$min"].(bson.M)["first."+name] = pointDoc(metric.First)
+			update["$max"].(bson.M)["last."+name] = pointDoc(metric.Last)
+		}
+
+		// add sketch buckets
+		for bucket, count := range metric.Sketch {
+			update["$inc"].(bson.M)["samples."+key+"."+name+".sketch."+bucket] = int(count)
+			update["$inc"].(bson.M)["sketch."+name+"."+bucket] = int(count)
+		}
+
+		// add hyperloglog registers
+		for index, rank := range metric.HLL {
+			update["$max"].(bson.M)["samples."+key+"."+name+".hll."+index] = rank
+			update["$max"].(bson.M)["hll."+name+"."+index] = rank
+		}
+	}
+
+	// remove empty operators as they are rejected before MongoDB 5.0
+	for operator, fields := range update {
+		if len(fields.(bson.M)) == 0 {
+			delete(update, operator)
+		}
 	}
 
-	return query, update
+	return Upsert{Query: query, Update: update}
 }
 
+func (c *Collection) replaceSample(start time.Time, key string, metrics map[string]Metric, tags bson.M) Upsert {
+	// prepare query
+	query := bson.M{
+		"start":  start,
+		"series": SeriesID(tags),
+	}
+
+	// prepare fields
+	fields := bson.M{
+		"tags":                      bson.M{"$literal": normalizeTags(tags)},
+		"samples." + key + ".start": c.res.Join(start, key),
+	}
+
+	// replace sample metrics
+	names := make([]string, 0, len(metrics))
+	for name, metric := range metrics {
+		fields["samples."+key+"."+name] = bson.M{
+			"$literal": bson.M{
+				"max":   metric.Max,
+				"min":   metric.Min,
+				"num":   int(metric.Num),
+				"sum":   metric.Sum,
+				"sumsq": metric.SumSq,
+				"first": pointDoc(metric.First),
+				"last":  pointDoc(metric.Last),
+			},
+		}
+
+		names = append(names, name)
+	}
+
+	// prepare pipeline
+	pipeline := []bson.M{
+		{"$set": fields},
+		recomputeSetStage(names),
+	}
+
+	return Upsert{Query: query, Pipeline: pipeline}
+}
+
+// AllMetrics can be passed as a metric name to aggregate all metrics that are
+// stored in the matched sets.
+const AllMetrics = "*"
+
 // AggregateSamples will aggregate all samples within sets that match the
-// specified time range and tags.
+// specified time range and tags. The rate of each metric is calculated using
+// the duration of the sample.
 func (c *Collection) AggregateSamples(first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
-	// get first and last sample
-	firstSample := c.res.SampleTimestamp(first)
-	lastSample := c.res.SampleTimestamp(last)
+	return c.AggregateSamplesContext(context.Background(), first, last, metrics, tags)
+}
 
-	// prepare aggregation pipeline
-	pipeline := []bson.M{
-		// get all matching sets
-		{
-			"$match": c.matchSets(firstSample, lastSample, tags),
-		},
-		// turn samples into an array
-		{
-			"$addFields": bson.M{
-				"samples": bson.M{"$objectToArray": "$samples"},
-			},
-		},
-		// create a document for each sample
-		{
-			"$unwind": "$samples",
-		},
-		// make the sample the main document
-		{
-			"$replaceRoot": bson.M{"newRoot": "$samples.v"},
-		},
-		// match the exact time range
-		{
-			"$match": bson.M{
-				"start": bson.M{
-					"$gte": firstSample,
-					"$lte": lastSample,
-				},
-			},
-		},
-		// group samples
-		{
-			"$group": bson.M{
-				"_id": "$start",
-				// more fields added below
-			},
-		},
-		// finalize layout
-		{
-			"$project": bson.M{
-				"_id":     false,
-				"start":   "$_id",
-				"metrics": bson.M{
-					// fields added below
-				},
-			},
-		},
-		// sort samples
-		{
-			"$sort": bson.M{"start": 1},
-		},
+// AggregateSamplesContext will aggregate all samples like AggregateSamples but
+// abort when the deadline of the context is exceeded or, if supported by the
+// backend, when the context is cancelled. The context error is returned in
+// that case.
+func (c *Collection) AggregateSamplesContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
+	// aggregate samples
+	samples, err := c.aggregateSamples(ctx, first, last, 0, nil, metrics, tags, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	// update pipeline
-	for _, name := range metrics {
-		// add group fields
-		pipeline[5]["$group"].(bson.M)["max_"+name] = bson.M{"$max": "$" + name + ".max"}
-		pipeline[5]["$group"].(bson.M)["min_"+name] = bson.M{"$min": "$" + name + ".min"}
-		pipeline[5]["$group"].(bson.M)["num_"+name] = bson.M{"$sum": "$" + name + ".num"}
-		pipeline[5]["$group"].(bson.M)["sum_"+name] = bson.M{"$sum": "$" + name + ".sum"}
-
-		// add project fields
-		pipeline[6]["$project"].(bson.M)["metrics"].(bson.M)[name] = bson.M{
-			"max": "$max_" + name,
-			"min": "$min_" + name,
-			"num": "$num_" + name,
-			"sum": "$sum_" + name,
-		}
+	return &TimeSeries{samples}, nil
+}
+
+// AggregateSamplesStep will aggregate all samples like AggregateSamples but
+// merge them into buckets of the specified step that are aligned to the Unix
+// epoch. The step should be a multiple of the sample duration and must be a
+// positive whole number of milliseconds. The rate of each metric is calculated
+// using the step.
+func (c *Collection) AggregateSamplesStep(first, last time.Time, step time.Duration, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.AggregateSamplesStepContext(context.Background(), first, last, step, metrics, tags)
+}
+
+// AggregateSamplesStepContext will aggregate all samples like
+// AggregateSamplesStep but use the specified context like
+// AggregateSamplesContext.
+func (c *Collection) AggregateSamplesStepContext(ctx context.Context, first, last time.Time, step time.Duration, metrics []string, tags bson.M) (*TimeSeries, error) {
+	// check step
+	if !validStep(step) {
+		return nil, ErrInvalidStep
 	}
 
-	// fetch result
-	var samples []Sample
-	err := c.coll.Pipe(pipeline).All(&samples)
+	// aggregate samples
+	samples, err := c.aggregateSamples(ctx, first, last, step, nil, metrics, tags, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -177,58 +520,33 @@ func (c *Collection) AggregateSamples(first, last time.Time, metrics []string, t
 	return &TimeSeries{samples}, nil
 }
 
-// AggregateSets will aggregate only set level metrics matching the specified
-// time range and tags.
-func (c *Collection) AggregateSets(first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
-	// prepare aggregation pipeline
-	pipeline := []bson.M{
-		// get all matching sets
-		{
-			"$match": c.matchSets(first, last, tags),
-		},
-		// group samples
-		{
-			"$group": bson.M{
-				"_id": "$start",
-				// more fields added below
-			},
-		},
-		// finalize layout
-		{
-			"$project": bson.M{
-				"_id":     false,
-				"start":   "$_id",
-				"metrics": bson.M{
-					// fields added below
-				},
-			},
-		},
-		// sort samples
-		{
-			"$sort": bson.M{"start": 1},
-		},
+// AggregateSamplesStepIn will aggregate all samples like AggregateSamplesStep
+// but align the buckets to the wall clock in the specified location. Steps
+// shorter than a day must evenly divide a day and are cut at the same local
+// times every day. Longer steps must be a whole number of days and span that
+// many calendar days in the location, aligned to the Unix epoch. Buckets may be
+// shorter or longer due to daylight saving time, which is reflected in the
+// rates. The location must be loadable by its name (e.g. "Europe/Zurich").
+func (c *Collection) AggregateSamplesStepIn(first, last time.Time, step time.Duration, loc *time.Location, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.AggregateSamplesStepInContext(context.Background(), first, last, step, loc, metrics, tags)
+}
+
+// AggregateSamplesStepInContext will aggregate all samples like
+// AggregateSamplesStepIn but use the specified context like
+// AggregateSamplesContext.
+func (c *Collection) AggregateSamplesStepInContext(ctx context.Context, first, last time.Time, step time.Duration, loc *time.Location, metrics []string, tags bson.M) (*TimeSeries, error) {
+	// check step
+	if !validStep(step) || (step < 24*time.Hour && (24*time.Hour)%step != 0) || (step > 24*time.Hour && step%(24*time.Hour) != 0) {
+		return nil, ErrInvalidStep
 	}
 
-	// update pipeline
-	for _, name := range metrics {
-		// add group fields
-		pipeline[1]["$group"].(bson.M)["max_"+name] = bson.M{"$max": "$max." + name}
-		pipeline[1]["$group"].(bson.M)["min_"+name] = bson.M{"$min": "$min." + name}
-		pipeline[1]["$group"].(bson.M)["num_"+name] = bson.M{"$sum": "$num." + name}
-		pipeline[1]["$group"].(bson.M)["sum_"+name] = bson.M{"$sum": "$sum." + name}
-
-		// add project fields
-		pipeline[2]["$project"].(bson.M)["metrics"].(bson.M)[name] = bson.M{
-			"max": "$max_" + name,
-			"min": "$min_" + name,
-			"num": "$num_" + name,
-			"sum": "$sum_" + name,
-		}
+	// check location
+	if _, err := time.LoadLocation(loc.String()); err != nil || loc.String() == "Local" {
+		return nil, ErrInvalidLocation
 	}
 
-	// fetch result
-	var samples []Sample
-	err := c.coll.Pipe(pipeline).All(&samples)
+	// aggregate samples
+	samples, err := c.aggregateSamples(ctx, first, last, step, loc, metrics, tags, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -236,61 +554,447 @@ func (c *Collection) AggregateSets(first, last time.Time, metrics []string, tags
 	return &TimeSeries{samples}, nil
 }
 
-func (c *Collection) matchSets(first, last time.Time, tags bson.M) bson.M {
-	// get first and last set
-	firstSet, _ := c.res.Split(first)
-	lastSet, _ := c.res.Split(last)
-
-	// create basic matcher
-	match := bson.M{
-		"start": bson.M{
-			"$gte": firstSet,
-			"$lte": lastSet,
-		},
+// AggregateSamplesBy will aggregate all samples like AggregateSamples but
+// return a separate time series for every distinct combination of values of
+// the specified tag keys. The groups are computed in a single aggregation and
+// returned sorted by their tags.
+func (c *Collection) AggregateSamplesBy(first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Group, error) {
+	return c.AggregateSamplesByContext(context.Background(), first, last, metrics, tags, groupBy)
+}
+
+// AggregateSamplesByContext will aggregate all samples like AggregateSamplesBy
+// but use the specified context like AggregateSamplesContext.
+func (c *Collection) AggregateSamplesByContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Group, error) {
+	// aggregate samples
+	samples, err := c.aggregateSamples(ctx, first, last, 0, nil, metrics, tags, groupBy)
+	if err != nil {
+		return nil, err
 	}
 
-	// add tags
-	for key, value := range tags {
-		match["tags."+key] = value
+	return groupSamples(samples), nil
+}
+
+func (c *Collection) aggregateSamples(ctx context.Context, first, last time.Time, step time.Duration, loc *time.Location, metrics []string, tags bson.M, groupBy []string) ([]Sample, error) {
+	// prepare query
+	query, err := c.samplesQuery(ctx, first, last, step, loc, metrics, tags, groupBy)
+	if err != nil {
+		return nil, err
 	}
 
-	return match
+	// aggregate samples
+	samples, err := c.backend.AggregateSamples(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// calculate rates
+	for _, sample := range samples {
+		c.calculateRates(sample, step, loc)
+	}
+
+	return samples, nil
 }
 
-// EnsureIndexes will ensure that the necessary indexes have been created. If
-// removeAfter is specified, sets are automatically removed when their start
-// timestamp falls behind the specified duration.
-//
-// Note: It is recommended to create custom indexes that support the exact
-// nature of data and access patterns.
-func (c *Collection) EnsureIndexes(removeAfter time.Duration) error {
-	// ensure start index
-	err := c.coll.EnsureIndex(mgo.Index{
-		Key:         []string{"start"},
-		ExpireAfter: removeAfter,
-		Background:  true,
-	})
+func (c *Collection) samplesQuery(ctx context.Context, first, last time.Time, step time.Duration, loc *time.Location, metrics []string, tags bson.M, groupBy []string) (Query, error) {
+	// get first and last sample
+	firstSample := c.res.SampleTimestamp(first)
+	lastSample := c.res.SampleTimestamp(last)
+
+	// prepare query
+	query := Query{
+		FirstSet:    c.res.SetTimestamp(firstSample),
+		LastSet:     c.res.SetTimestamp(lastSample),
+		FirstSample: firstSample,
+		LastSample:  lastSample,
+		Metrics:     metrics,
+		Tags:        tags,
+		Step:        step,
+		Location:    loc,
+		GroupBy:     groupBy,
+	}
+
+	// expand wildcard
+	err := c.expandMetrics(ctx, &query)
 	if err != nil {
-		return err
+		return Query{}, err
 	}
 
-	// ensure tags index
-	err = c.coll.EnsureIndex(mgo.Index{
-		Key:        []string{"tags"},
-		Background: true,
-	})
+	return query, nil
+}
+
+func (c *Collection) calculateRates(sample Sample, step time.Duration, loc *time.Location) {
+	// get duration
+	seconds := sampleDuration(c.res, sample.Start).Seconds()
+	if bucket := bucketDuration(sample.Start, step, loc).Seconds(); bucket > seconds {
+		seconds = bucket
+	}
+
+	// set rates
+	for name, metric := range sample.Metrics {
+		metric.Rate = metric.Sum / seconds
+		sample.Metrics[name] = metric
+	}
+}
+
+// AggregateSets will aggregate only set level metrics matching the specified
+// time range and tags.
+func (c *Collection) AggregateSets(first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.AggregateSetsContext(context.Background(), first, last, metrics, tags)
+}
+
+// AggregateSetsContext will aggregate only set level metrics like
+// AggregateSets but use the specified context like AggregateSamplesContext.
+func (c *Collection) AggregateSetsContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
+	// aggregate sets
+	samples, err := c.aggregateSets(ctx, first, last, metrics, tags, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// ensure start tags index
-	err = c.coll.EnsureIndex(mgo.Index{
-		Key:        []string{"start", "tags"},
-		Background: true,
-	})
+	return &TimeSeries{samples}, nil
+}
+
+// AggregateSetsBy will aggregate only set level metrics like AggregateSets but
+// return a separate time series for every distinct combination of values of
+// the specified tag keys. The groups are computed in a single aggregation and
+// returned sorted by their tags.
+func (c *Collection) AggregateSetsBy(first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Group, error) {
+	return c.AggregateSetsByContext(context.Background(), first, last, metrics, tags, groupBy)
+}
+
+// AggregateSetsByContext will aggregate only set level metrics like
+// AggregateSetsBy but use the specified context like AggregateSamplesContext.
+func (c *Collection) AggregateSetsByContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Group, error) {
+	// aggregate sets
+	samples, err := c.aggregateSets(ctx, first, last, metrics, tags, groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	return groupSamples(samples), nil
+}
+
+func (c *Collection) aggregateSets(ctx context.Context, first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Sample, error) {
+	// prepare query
+	query, err := c.setsQuery(ctx, first, last, metrics, tags, groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.backend.AggregateSets(ctx, query)
+}
+
+func (c *Collection) setsQuery(ctx context.Context, first, last time.Time, metrics []string, tags bson.M, groupBy []string) (Query, error) {
+	// prepare query
+	query := Query{
+		FirstSet: c.res.SetTimestamp(first),
+		LastSet:  c.res.SetTimestamp(last),
+		Metrics:  metrics,
+		Tags:     tags,
+		GroupBy:  groupBy,
+	}
+
+	// expand wildcard
+	err := c.expandMetrics(ctx, &query)
+	if err != nil {
+		return Query{}, err
+	}
+
+	return query, nil
+}
+
+func validStep(step time.Duration) bool {
+	return step > 0 && step%time.Millisecond == 0
+}
+
+func bucketDuration(start time.Time, step time.Duration, loc *time.Location) time.Duration {
+	// check location
+	if loc == nil {
+		return step
+	}
+
+	// get local start
+	local := start.In(loc)
+
+	// get calendar days duration
+	if step >= 24*time.Hour {
+		return local.AddDate(0, 0, int(step/(24*time.Hour))).Sub(local)
+	}
+
+	// get wall clock duration
+	end := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), local.Nanosecond()+int(step), loc)
+
+	return end.Sub(local)
+}
+
+func (c *Collection) expandMetrics(ctx context.Context, query *Query) error {
+	// check for wildcard
+	var found bool
+	for _, name := range query.Metrics {
+		if name == AllMetrics {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	// get all names
+	all, err := c.backend.Metrics(ctx, *query)
 	if err != nil {
 		return err
 	}
 
+	// merge names
+	index := map[string]bool{}
+	names := make([]string, 0, len(query.Metrics)+len(all))
+	for _, list := range [][]string{query.Metrics, all} {
+		for _, name := range list {
+			if name != AllMetrics && !index[name] {
+				index[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	// set names
+	query.Metrics = names
+
+	return nil
+}
+
+// Delete will remove all samples within the specified time range of the series
+// matching the specified tags. Sets that are fully covered by the range are
+// removed while the samples of partially covered sets are unset and their set
+// level metrics are recomputed from the remaining samples.
+//
+// Note: Deleting samples of partially covered sets requires MongoDB 4.2 or
+// newer. The set level sketches and distinct counts of those sets are not
+// recomputed.
+func (c *Collection) Delete(first, last time.Time, tags bson.M) error {
+	return c.DeleteContext(context.Background(), first, last, tags)
+}
+
+// DeleteContext will remove all samples within the specified time range like
+// Delete but abort when the deadline of the context is exceeded or, if
+// supported by the backend, when the context is cancelled. The context error is
+// returned in that case.
+//
+// Note: Sets and samples that have been removed before the operation has been
+// aborted stay removed.
+func (c *Collection) DeleteContext(ctx context.Context, first, last time.Time, tags bson.M) error {
+	// get first and last sample
+	firstSample := c.res.SampleTimestamp(first)
+	lastSample := c.res.SampleTimestamp(last)
+
+	// get first and last set
+	firstSet := c.res.SetTimestamp(firstSample)
+	lastSet := c.res.SetTimestamp(lastSample)
+
+	// check if the edge sets are only partially covered
+	firstPartial := !firstSample.Equal(firstSet)
+	lastPartial := c.res.SetTimestamp(lastSample.Add(sampleDuration(c.res, lastSample))).Equal(lastSet)
+
+	// prepare query for fully covered sets
+	query := Query{
+		FirstSet: firstSet,
+		LastSet:  lastSet,
+		Tags:     tags,
+	}
+
+	// unset samples of first set
+	if firstPartial {
+		err := c.deleteSamples(ctx, firstSet, firstSample, lastSample, tags)
+		if err != nil {
+			return err
+		}
+
+		query.FirstSet = firstSet.Add(time.Nanosecond)
+	}
+
+	// unset samples of last set if not already handled
+	if lastPartial {
+		if !firstPartial || !lastSet.Equal(firstSet) {
+			err := c.deleteSamples(ctx, lastSet, lastSet, lastSample, tags)
+			if err != nil {
+				return err
+			}
+		}
+
+		query.LastSet = lastSet.Add(-time.Nanosecond)
+	}
+
+	// remove fully covered sets
+	if !query.FirstSet.After(query.LastSet) {
+		_, err := c.backend.Remove(ctx, query)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+func (c *Collection) deleteSamples(ctx context.Context, set, first, last time.Time, tags bson.M) error {
+	// collect sample paths within the set
+	var paths []string
+	for t := first; !t.After(last) && c.res.SetTimestamp(t).Equal(set); t = t.Add(sampleDuration(c.res, t)) {
+		paths = append(paths, "samples."+c.res.SampleKey(t))
+	}
+
+	// prepare pipeline
+	pipeline := []bson.M{
+		{"$unset": paths},
+		recomputeAllSetStage(),
+	}
+
+	return c.backend.Update(ctx, Query{
+		FirstSet: set,
+		LastSet:  set,
+		Tags:     tags,
+	}, pipeline)
+}
+
+func newMetric(p Point) Metric {
+	return Metric{
+		Max:   p.Value,
+		Min:   p.Value,
+		Num:   1,
+		Sum:   p.Value,
+		SumSq: p.Value * p.Value,
+		First: p,
+		Last:  p,
+	}
+}
+
+func pointDoc(p Point) bson.D {
+	// the ordered document ensures that points are compared by time first
+	return bson.D{
+		{Name: "t", Value: p.Time},
+		{Name: "v", Value: p.Value},
+	}
+}
+
+// SeriesID will return the canonical identifier of the series with the
+// specified tags. The identifier is derived from the BSON encoding of the tags
+// with recursively sorted keys and times in UTC and is stored with every set to
+// identify its series independently of the tag order.
+//
+// Note: Tag values that are encoded as different BSON types (e.g. int64 and
+// float64) yield different identifiers even if MongoDB considers them equal.
+func SeriesID(tags bson.M) string {
+	// encode canonical tags
+	data, err := bson.Marshal(canonicalTags(tags))
+	if err != nil {
+		data = []byte(tagsKey(tags))
+	}
+
+	// hash encoding
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:16])
+}
+
+// Exact will return query tags that only match the series with exactly the
+// specified tags using the indexed series identifier.
+func Exact(tags bson.M) bson.M {
+	return bson.M{seriesKey: SeriesID(tags)}
+}
+
+func normalizeTags(tags bson.M) bson.M {
+	// store missing tags as empty document
+	if tags == nil {
+		return bson.M{}
+	}
+
+	return tags
+}
+
+func tagsKey(tags bson.M) string {
+	// empty tags are stored the same
+	if len(tags) == 0 {
+		return ""
+	}
+
+	// format canonical tags
+	return fmt.Sprintf("%#v", canonicalTags(tags))
+}
+
+func canonicalTags(tags bson.M) bson.D {
+	// sort keys
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// build document
+	doc := make(bson.D, 0, len(keys))
+	for _, key := range keys {
+		doc = append(doc, bson.DocElem{Name: key, Value: canonicalValue(tags[key])})
+	}
+
+	return doc
+}
+
+func canonicalValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case bson.M:
+		return canonicalTags(value)
+	case map[string]interface{}:
+		return canonicalTags(value)
+	case bson.D:
+		// keep order as it is significant for documents
+		doc := make(bson.D, 0, len(value))
+		for _, item := range value {
+			doc = append(doc, bson.DocElem{Name: item.Name, Value: canonicalValue(item.Value)})
+		}
+		return doc
+	case []interface{}:
+		list := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			list = append(list, canonicalValue(item))
+		}
+		return list
+	case time.Time:
+		// times are stored in UTC with millisecond precision
+		return value.UTC().Truncate(time.Millisecond)
+	default:
+		return value
+	}
+}
+
+// MigrateSeries will set the series identifier on all sets that have been
+// written by earlier versions and lack it. It should be run once before the
+// collection is written by this version, as inserts will otherwise create a
+// second set for every existing set of a series. It will return the number of
+// updated sets.
+func (c *Collection) MigrateSeries() (int, error) {
+	return c.MigrateSeriesContext(context.Background())
+}
+
+// MigrateSeriesContext will set the missing series identifiers like
+// MigrateSeries but abort when the deadline of the context is exceeded or, if
+// supported by the backend, when the context is cancelled. The context error is
+// returned in that case. Sets updated before the abort keep their identifier.
+func (c *Collection) MigrateSeriesContext(ctx context.Context) (int, error) {
+	return c.backend.MigrateSeries(ctx, SeriesID)
+}
+
+// EnsureIndexes will ensure that the necessary indexes have been created. If
+// removeAfter is specified, sets are automatically removed when their start
+// timestamp falls behind the specified duration.
+//
+// Note: It is recommended to create custom indexes that support the exact
+// nature of data and access patterns.
+func (c *Collection) EnsureIndexes(removeAfter time.Duration) error {
+	return c.EnsureIndexesContext(context.Background(), removeAfter)
+}
+
+// EnsureIndexesContext will ensure the necessary indexes like EnsureIndexes but
+// abort when the deadline of the context is exceeded or, if supported by the
+// backend, when the context is cancelled. The context error is returned in
+// that case.
+func (c *Collection) EnsureIndexesContext(ctx context.Context, removeAfter time.Duration) error {
+	return c.backend.EnsureIndexes(ctx, removeAfter)
+}
@@ -1,6 +1,8 @@
 package mgots
 
 import (
+	"context"
+	"strconv"
 	"testing"
 	"time"
 
@@ -9,6 +11,8 @@ import (
 )
 
 func TestCollectionInsert(t *testing.T) {
+	requireMongo(t)
+
 	dbc := db.C("test-coll-insert")
 	tsc := Wrap(dbc, OneMinuteOf60Seconds)
 
@@ -37,16 +41,29 @@ func TestCollectionInsert(t *testing.T) {
 			"min": bson.M{
 				"value": float64(10),
 			},
-			"start": parseTime("Jul 15 15:15:00"),
-			"tags":  bson.M{},
+			"sumsq": bson.M{
+				"value": float64(100),
+			},
+			"first": bson.M{
+				"value": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(10)},
+			},
+			"last": bson.M{
+				"value": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(10)},
+			},
+			"start":  parseTime("Jul 15 15:15:00"),
+			"series": SeriesID(nil),
+			"tags":   bson.M{},
 			"samples": bson.M{
 				"15": bson.M{
 					"start": parseTime("Jul 15 15:15:15"),
 					"value": bson.M{
-						"sum": float64(10),
-						"num": int(1),
-						"max": float64(10),
-						"min": float64(10),
+						"sum":   float64(10),
+						"num":   int(1),
+						"max":   float64(10),
+						"min":   float64(10),
+						"sumsq": float64(100),
+						"first": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(10)},
+						"last":  bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(10)},
 					},
 				},
 			},
@@ -55,6 +72,8 @@ func TestCollectionInsert(t *testing.T) {
 }
 
 func TestCollectionBulkInsert(t *testing.T) {
+	requireMongo(t)
+
 	dbc := db.C("test-coll-bulk-insert")
 	tsc := Wrap(dbc, OneMinuteOf60Seconds)
 	bulk := tsc.Bulk()
@@ -76,16 +95,20 @@ func TestCollectionBulkInsert(t *testing.T) {
 
 	assert.Equal(t, []bson.M{
 		{
-			"start": parseTime("Jul 15 15:15:00"),
-			"tags":  bson.M{},
+			"start":  parseTime("Jul 15 15:15:00"),
+			"series": SeriesID(nil),
+			"tags":   bson.M{},
 			"samples": bson.M{
 				"15": bson.M{
 					"start": parseTime("Jul 15 15:15:15"),
 					"value": bson.M{
-						"sum": float64(1),
-						"num": int(2),
-						"max": float64(1),
-						"min": float64(0),
+						"sum":   float64(1),
+						"num":   int(2),
+						"max":   float64(1),
+						"min":   float64(0),
+						"sumsq": float64(1),
+						"first": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(0)},
+						"last":  bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(1)},
 					},
 				},
 			},
@@ -101,11 +124,213 @@ func TestCollectionBulkInsert(t *testing.T) {
 			"min": bson.M{
 				"value": float64(0),
 			},
+			"sumsq": bson.M{
+				"value": float64(1),
+			},
+			"first": bson.M{
+				"value": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(0)},
+			},
+			"last": bson.M{
+				"value": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(1)},
+			},
 		},
 	}, forceUTCSlice(data))
 }
 
+func TestCollectionBulkPreAggregation(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	bulk := tsc.Bulk()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 100; i++ {
+		bulk.Insert(now, map[string]float64{
+			"value": float64(i),
+		}, bson.M{"foo": "bar", "host": "one"})
+
+		bulk.Insert(now.Add(time.Second), map[string]float64{
+			"value": float64(i),
+		}, bson.M{"host": "one", "foo": "bar"})
+
+		bulk.Insert(now, map[string]float64{
+			"value": float64(i),
+		}, bson.M{"foo": "bar", "host": "two"})
+	}
+
+	upserts := bulk.upserts()
+	assert.Len(t, upserts, 3)
+	assert.Equal(t, bson.M{
+		"samples.15.value.sum":   float64(4950),
+		"samples.15.value.num":   int(100),
+		"samples.15.value.sumsq": float64(328350),
+		"sum.value":              float64(4950),
+		"num.value":              int(100),
+		"sumsq.value":            float64(328350),
+	}, upserts[0].Update["$inc"])
+	assert.Equal(t, bson.M{
+		"samples.15.value.max":  float64(99),
+		"samples.15.value.last": pointDoc(Point{Time: now, Value: 99}),
+		"max.value":             float64(99),
+		"last.value":            pointDoc(Point{Time: now, Value: 99}),
+	}, upserts[0].Update["$max"])
+	assert.Equal(t, bson.M{
+		"samples.15.value.min":   float64(0),
+		"samples.15.value.first": pointDoc(Point{Time: now, Value: 0}),
+		"min.value":              float64(0),
+		"first.value":            pointDoc(Point{Time: now, Value: 0}),
+	}, upserts[0].Update["$min"])
+
+	err := bulk.Run()
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSamples(now, now.Add(time.Second), []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &TimeSeries{
+		Samples: []Sample{
+			{
+				Start: parseTime("Jul 15 15:15:15"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 99, Min: 0, Num: 200, Sum: 9900, SumSq: 656700, Rate: 9900,
+						First: Point{Time: parseTime("Jul 15 15:15:15"), Value: 0},
+						Last:  Point{Time: parseTime("Jul 15 15:15:15"), Value: 99},
+					},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:15:16"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 99, Min: 0, Num: 100, Sum: 4950, SumSq: 328350, Rate: 4950,
+						First: Point{Time: parseTime("Jul 15 15:15:16"), Value: 0},
+						Last:  Point{Time: parseTime("Jul 15 15:15:16"), Value: 99},
+					},
+				},
+			},
+		},
+	}, ts)
+}
+
+func TestCollectionInsertDistinct(t *testing.T) {
+	requireMongo(t)
+
+	tsc := Wrap(db.C("test-coll-insert-distinct"), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	bulk := tsc.Bulk()
+	for i := 0; i < 1000; i++ {
+		bulk.InsertDistinct(now.Add(time.Duration(i%10)*time.Second), map[string][]string{
+			"users": {"user-" + strconv.Itoa(i%200)},
+		}, nil)
+	}
+	assert.NoError(t, bulk.Run())
+
+	err := tsc.InsertDistinct(now, map[string][]string{
+		"users": {"user-1000"},
+	}, nil)
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSamples(now, now.Add(time.Minute), []string{"users"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 10)
+	assert.InEpsilon(t, 21, ts.Samples[0].Metrics["users"].Cardinality(), 0.1)
+	assert.InEpsilon(t, 201, ts.Cardinality("users"), 0.1)
+	assert.Equal(t, int64(0), ts.Num("users"))
+
+	ts, err = tsc.AggregateSets(now, now.Add(time.Minute), []string{"users"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+	assert.InEpsilon(t, 201, ts.Cardinality("users"), 0.1)
+}
+
+func TestCollectionUpsertSampleOperators(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	bulk := tsc.Bulk()
+	bulk.InsertDistinct(now, map[string][]string{
+		"users": {"user-1"},
+	}, nil)
+
+	upserts := bulk.upserts()
+	assert.Len(t, upserts, 1)
+
+	for operator, fields := range upserts[0].Update {
+		assert.NotEmpty(t, fields, operator)
+	}
+	assert.NotContains(t, upserts[0].Update, "$inc")
+	assert.NotContains(t, upserts[0].Update, "$min")
+}
+
+func TestCollectionInsertGauge(t *testing.T) {
+	requireMongo(t)
+
+	tsc := Wrap(db.C("test-coll-insert-gauge"), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 2; i++ {
+		err := tsc.InsertGauge(now, map[string]float64{
+			"value": 10,
+		}, nil)
+		assert.NoError(t, err)
+
+		err = tsc.InsertGauge(now.Add(time.Second), map[string]float64{
+			"value": 5,
+		}, nil)
+		assert.NoError(t, err)
+	}
+
+	ts, err := tsc.AggregateSets(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &TimeSeries{
+		Samples: []Sample{
+			{
+				Start: parseTime("Jul 15 15:15:00"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 10, Min: 5, Num: 2, Sum: 15, SumSq: 125,
+						First: Point{Time: parseTime("Jul 15 15:15:15"), Value: 10},
+						Last:  Point{Time: parseTime("Jul 15 15:15:16"), Value: 5},
+					},
+				},
+			},
+		},
+	}, forceUTCTimeSeries(ts))
+}
+
+func TestCollectionDelete(t *testing.T) {
+	requireMongo(t)
+
+	tsc := Wrap(db.C("test-coll-delete"), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:14:00")
+
+	bulk := tsc.Bulk()
+	for i := 0; i < 18; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*10*time.Second), map[string]float64{
+			"value": float64(i),
+		}, nil)
+	}
+	assert.NoError(t, bulk.Run())
+
+	err := tsc.Delete(parseTime("Jul 15 15:14:30"), parseTime("Jul 15 15:16:20"), nil)
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSets(now, now.Add(3*time.Minute), []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 2)
+	assert.Equal(t, int64(6), ts.Num("value"))
+	assert.Equal(t, float64(51), ts.Sum("value"))
+	assert.Equal(t, float64(0), ts.Min("value"))
+	assert.Equal(t, float64(17), ts.Max("value"))
+}
+
 func TestCollectionAggregateSamples(t *testing.T) {
+	requireMongo(t)
+
 	dbc := db.C("test-coll-aggregate-samples")
 	tsc := Wrap(dbc, OneMinuteOf60Seconds)
 
@@ -152,26 +377,192 @@ func TestCollectionAggregateSamples(t *testing.T) {
 			{
 				Start: parseTime("Jul 15 15:15:16"),
 				Metrics: map[string]Metric{
-					"value": {Max: 21, Min: 1, Num: 3, Sum: 33},
+					"value": {
+						Max: 21, Min: 1, Num: 3, Sum: 33, SumSq: 563, Rate: 33,
+						First: Point{Time: parseTime("Jul 15 15:15:16"), Value: 1},
+						Last:  Point{Time: parseTime("Jul 15 15:15:16"), Value: 21},
+					},
 				},
 			},
 			{
 				Start: parseTime("Jul 15 15:15:17"),
 				Metrics: map[string]Metric{
-					"value": {Max: 22, Min: 2, Num: 3, Sum: 36},
+					"value": {
+						Max: 22, Min: 2, Num: 3, Sum: 36, SumSq: 632, Rate: 36,
+						First: Point{Time: parseTime("Jul 15 15:15:17"), Value: 2},
+						Last:  Point{Time: parseTime("Jul 15 15:15:17"), Value: 22},
+					},
 				},
 			},
 			{
 				Start: parseTime("Jul 15 15:15:18"),
 				Metrics: map[string]Metric{
-					"value": {Max: 23, Min: 3, Num: 3, Sum: 39},
+					"value": {
+						Max: 23, Min: 3, Num: 3, Sum: 39, SumSq: 707, Rate: 39,
+						First: Point{Time: parseTime("Jul 15 15:15:18"), Value: 3},
+						Last:  Point{Time: parseTime("Jul 15 15:15:18"), Value: 23},
+					},
 				},
 			},
 		},
 	}, forceUTCTimeSeries(ts))
 }
 
+func TestCollectionAggregateBy(t *testing.T) {
+	requireMongo(t)
+
+	testAggregateBy(t, Wrap(db.C("test-coll-aggregate-by"), OneMinuteOf60Seconds))
+}
+
+func testAggregateBy(t *testing.T, tsc *Collection) {
+	now := parseTime("Jul 15 15:15:15")
+
+	bulk := tsc.Bulk()
+	for i := 0; i < 3; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{"cpu": 1}, bson.M{"server": "a", "core": 1})
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{"cpu": 2}, bson.M{"server": "a", "core": 2})
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{"cpu": 4}, bson.M{"server": "b", "core": 1})
+	}
+	bulk.Insert(now, map[string]float64{"cpu": 8}, nil)
+	assert.NoError(t, bulk.Run())
+
+	groups, err := tsc.AggregateSamplesBy(now, now.Add(2*time.Second), []string{"cpu"}, nil, []string{"server"})
+	assert.NoError(t, err)
+	assert.Len(t, groups, 3)
+
+	assert.Equal(t, bson.M{}, groups[0].Tags)
+	assert.Len(t, groups[0].Series.Samples, 1)
+	assert.Equal(t, float64(8), groups[0].Series.Sum("cpu"))
+
+	assert.Equal(t, bson.M{"server": "a"}, groups[1].Tags)
+	assert.Len(t, groups[1].Series.Samples, 3)
+	assert.Equal(t, float64(9), groups[1].Series.Sum("cpu"))
+	assert.Equal(t, int64(6), groups[1].Series.Num("cpu"))
+	assert.Nil(t, groups[1].Series.Samples[0].Tags)
+
+	assert.Equal(t, bson.M{"server": "b"}, groups[2].Tags)
+	assert.Equal(t, float64(12), groups[2].Series.Sum("cpu"))
+
+	groups, err = tsc.AggregateSetsBy(now, now, []string{"cpu"}, bson.M{"server": "a"}, []string{"server", "core"})
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, bson.M{"server": "a", "core": 1}, groups[0].Tags)
+	assert.Equal(t, float64(3), groups[0].Series.Sum("cpu"))
+	assert.Equal(t, bson.M{"server": "a", "core": 2}, groups[1].Tags)
+	assert.Equal(t, float64(6), groups[1].Series.Sum("cpu"))
+}
+
+func TestCollectionAggregateSamplesStep(t *testing.T) {
+	requireMongo(t)
+
+	testAggregateSamplesStep(t, Wrap(db.C("test-coll-aggregate-samples-step"), OneMinuteOf60Seconds))
+}
+
+func testAggregateSamplesStep(t *testing.T, tsc *Collection) {
+	now := parseTime("Jul 15 15:14:00")
+
+	bulk := tsc.Bulk()
+	for i := 0; i < 18; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*10*time.Second), map[string]float64{
+			"value": float64(i),
+		}, nil)
+	}
+	assert.NoError(t, bulk.Run())
+
+	ts, err := tsc.AggregateSamplesStep(now, now.Add(3*time.Minute), time.Minute, []string{"value"}, nil)
+	assert.NoError(t, err)
+	forceUTCTimeSeries(ts)
+	assert.Len(t, ts.Samples, 3)
+	assert.Equal(t, parseTime("Jul 15 15:14:00"), ts.Samples[0].Start)
+	assert.Equal(t, Metric{
+		Max: 5, Min: 0, Num: 6, Sum: 15, SumSq: 55,
+		First: Point{Time: parseTime("Jul 15 15:14:00"), Value: 0},
+		Last:  Point{Time: parseTime("Jul 15 15:14:50"), Value: 5},
+		Rate:  0.25,
+	}, ts.Samples[0].Metrics["value"])
+	assert.Equal(t, parseTime("Jul 15 15:16:00"), ts.Samples[2].Start)
+	assert.Equal(t, float64(87), ts.Samples[2].Metrics["value"].Sum)
+
+	ts, err = tsc.AggregateSamplesStep(now, now.Add(3*time.Minute), 90*time.Second, []string{"value"}, nil)
+	assert.NoError(t, err)
+	forceUTCTimeSeries(ts)
+	assert.Len(t, ts.Samples, 3)
+	assert.Equal(t, parseTime("Jul 15 15:13:30"), ts.Samples[0].Start)
+	assert.Equal(t, int64(6), ts.Samples[0].Metrics["value"].Num)
+	assert.Equal(t, parseTime("Jul 15 15:15:00"), ts.Samples[1].Start)
+	assert.Equal(t, int64(9), ts.Samples[1].Metrics["value"].Num)
+	assert.Equal(t, parseTime("Jul 15 15:16:30"), ts.Samples[2].Start)
+	assert.Equal(t, int64(3), ts.Samples[2].Metrics["value"].Num)
+
+	for _, step := range []time.Duration{0, -time.Minute, time.Microsecond, time.Second + time.Microsecond} {
+		_, err = tsc.AggregateSamplesStep(now, now.Add(3*time.Minute), step, []string{"value"}, nil)
+		assert.Equal(t, ErrInvalidStep, err, step.String())
+	}
+}
+
+func TestCollectionAggregateSamplesStepIn(t *testing.T) {
+	requireMongo(t)
+
+	loc, err := time.LoadLocation("Europe/Zurich")
+	assert.NoError(t, err)
+
+	testAggregateSamplesStepIn(t, Wrap(db.C("test-coll-aggregate-samples-step-in"), InLocation(OneDayOf24Hours, loc)), loc)
+}
+
+func testAggregateSamplesStepIn(t *testing.T, tsc *Collection, loc *time.Location) {
+	// daylight saving time ends on the second day
+	first := time.Date(2017, 10, 28, 0, 0, 0, 0, loc)
+	last := time.Date(2017, 10, 30, 0, 0, 0, 0, loc)
+
+	bulk := tsc.Bulk()
+	for ts := first; ts.Before(last); ts = ts.Add(time.Hour) {
+		bulk.Insert(ts, map[string]float64{"value": 1}, nil)
+	}
+	assert.NoError(t, bulk.Run())
+
+	ts, err := tsc.AggregateSamplesStepIn(first, last.Add(-time.Hour), 24*time.Hour, loc, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 2)
+	assert.True(t, first.Equal(ts.Samples[0].Start))
+	assert.Equal(t, float64(24), ts.Samples[0].Metrics["value"].Sum)
+	assert.Equal(t, float64(1)/3600, ts.Samples[0].Metrics["value"].Rate)
+	assert.True(t, first.AddDate(0, 0, 1).Equal(ts.Samples[1].Start))
+	assert.Equal(t, float64(25), ts.Samples[1].Metrics["value"].Sum)
+	assert.Equal(t, float64(1)/3600, ts.Samples[1].Metrics["value"].Rate)
+
+	ts, err = tsc.AggregateSamplesStepIn(first, last.Add(-time.Hour), 12*time.Hour, loc, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 4)
+	for i, sum := range []float64{12, 12, 13, 12} {
+		assert.True(t, first.Add(time.Duration(i)*12*time.Hour+time.Duration(i/3)*time.Hour).Equal(ts.Samples[i].Start), "%d", i)
+		assert.Equal(t, sum, ts.Samples[i].Metrics["value"].Sum, "%d", i)
+		assert.Equal(t, float64(1)/3600, ts.Samples[i].Metrics["value"].Rate, "%d", i)
+	}
+
+	ts, err = tsc.AggregateSamplesStepIn(first, last.Add(-time.Hour), 48*time.Hour, loc, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 2)
+	assert.True(t, first.AddDate(0, 0, -1).Equal(ts.Samples[0].Start))
+	assert.Equal(t, float64(24), ts.Samples[0].Metrics["value"].Sum)
+	assert.Equal(t, float64(24)/(48*3600), ts.Samples[0].Metrics["value"].Rate)
+	assert.True(t, first.AddDate(0, 0, 1).Equal(ts.Samples[1].Start))
+	assert.Equal(t, float64(25), ts.Samples[1].Metrics["value"].Sum)
+	assert.Equal(t, float64(25)/(49*3600), ts.Samples[1].Metrics["value"].Rate)
+
+	for _, step := range []time.Duration{0, 7 * time.Hour, 36 * time.Hour} {
+		_, err = tsc.AggregateSamplesStepIn(first, last, step, loc, []string{"value"}, nil)
+		assert.Equal(t, ErrInvalidStep, err, step.String())
+	}
+
+	for _, l := range []*time.Location{time.Local, time.FixedZone("X", 3600)} {
+		_, err = tsc.AggregateSamplesStepIn(first, last, time.Hour, l, []string{"value"}, nil)
+		assert.Equal(t, ErrInvalidLocation, err, l.String())
+	}
+}
+
 func TestCollectionAggregateSets(t *testing.T) {
+	requireMongo(t)
+
 	dbc := db.C("test-coll-aggregate-sets")
 	tsc := Wrap(dbc, OneMinuteOf60Seconds)
 
@@ -218,29 +609,154 @@ func TestCollectionAggregateSets(t *testing.T) {
 			{
 				Start: parseTime("Jul 15 15:16:00"),
 				Metrics: map[string]Metric{
-					"value": {Max: 21, Min: 1, Num: 3, Sum: 33},
+					"value": {
+						Max: 21, Min: 1, Num: 3, Sum: 33, SumSq: 563,
+						First: Point{Time: parseTime("Jul 15 15:16:15"), Value: 1},
+						Last:  Point{Time: parseTime("Jul 15 15:16:15"), Value: 21},
+					},
 				},
 			},
 			{
 				Start: parseTime("Jul 15 15:17:00"),
 				Metrics: map[string]Metric{
-					"value": {Max: 22, Min: 2, Num: 3, Sum: 36},
+					"value": {
+						Max: 22, Min: 2, Num: 3, Sum: 36, SumSq: 632,
+						First: Point{Time: parseTime("Jul 15 15:17:15"), Value: 2},
+						Last:  Point{Time: parseTime("Jul 15 15:17:15"), Value: 22},
+					},
 				},
 			},
 			{
 				Start: parseTime("Jul 15 15:18:00"),
 				Metrics: map[string]Metric{
-					"value": {Max: 23, Min: 3, Num: 3, Sum: 39},
+					"value": {
+						Max: 23, Min: 3, Num: 3, Sum: 39, SumSq: 707,
+						First: Point{Time: parseTime("Jul 15 15:18:15"), Value: 3},
+						Last:  Point{Time: parseTime("Jul 15 15:18:15"), Value: 23},
+					},
 				},
 			},
 		},
 	}, forceUTCTimeSeries(ts))
 }
 
+func TestCollectionSketches(t *testing.T) {
+	requireMongo(t)
+
+	tsc := Wrap(db.C("test-coll-sketches"), OneMinuteOf60Seconds)
+	tsc.EnableSketches("latency")
+
+	bulk := tsc.Bulk()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 1; i <= 1000; i++ {
+		bulk.Insert(now.Add(time.Duration(i%120)*time.Second), map[string]float64{
+			"latency": float64(i),
+		}, nil)
+	}
+
+	err := bulk.Run()
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSamples(now, now.Add(2*time.Minute), []string{"latency"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 120)
+	assert.InEpsilon(t, 500, ts.Quantile("latency", 0.5), SketchAccuracy*2)
+	assert.InEpsilon(t, 990, ts.Quantile("latency", 0.99), SketchAccuracy*2)
+
+	ts, err = tsc.AggregateSets(now, now.Add(2*time.Minute), []string{"latency"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 3)
+	assert.InEpsilon(t, 500, ts.Quantile("latency", 0.5), SketchAccuracy*2)
+}
+
 func TestCollectionEnsureIndexes(t *testing.T) {
+	requireMongo(t)
+
 	dbc := db.C("test-coll-ensure-indexes")
 	tsc := Wrap(dbc, OneHourOf60Minutes)
 
 	assert.NoError(t, tsc.EnsureIndexes(0))
 	assert.NoError(t, tsc.EnsureIndexes(0))
 }
+
+func TestCollectionContext(t *testing.T) {
+	requireMongo(t)
+
+	dbc := db.C("test-coll-context")
+	tsc := Wrap(dbc, OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:14:00")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	assert.NoError(t, tsc.InsertContext(ctx, now, map[string]float64{"value": 1}, nil))
+
+	ts, err := tsc.AggregateSamplesContext(ctx, now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), ts.Sum("value"))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	err = tsc.InsertContext(ctx, now, map[string]float64{"value": 1}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.AggregateSetsContext(ctx, now, now, []string{"value"}, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCollectionMigrateSeries(t *testing.T) {
+	testCollectionMigrateSeries(t, WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds))
+}
+
+func TestCollectionMigrateSeriesMongo(t *testing.T) {
+	requireMongo(t)
+
+	testCollectionMigrateSeries(t, Wrap(db.C("test-coll-migrate-series"), OneMinuteOf60Seconds))
+}
+
+func TestCollectionMigrateSeriesDriver(t *testing.T) {
+	requireMongo(t)
+
+	testCollectionMigrateSeries(t, WrapDriver(driverDB.Collection("test-driver-migrate-series"), OneMinuteOf60Seconds))
+}
+
+func testCollectionMigrateSeries(t *testing.T, tsc *Collection) {
+	now := parseTime("Jul 15 15:15:15")
+	tags := bson.M{"server": "a", "meta": bson.M{"rack": 1}}
+
+	assert.NoError(t, tsc.Insert(now, map[string]float64{"value": 1}, tags))
+	assert.NoError(t, tsc.Insert(now, map[string]float64{"value": 2}, nil))
+
+	// remove series like sets written by earlier versions
+	assert.NoError(t, tsc.backend.Update(context.Background(), Query{
+		FirstSet: time.Time{},
+		LastSet:  maxTime,
+	}, []bson.M{{"$unset": []string{"series"}}}))
+
+	ts, err := tsc.AggregateSets(now, now, []string{"value"}, Exact(tags))
+	assert.NoError(t, err)
+	assert.Empty(t, ts.Samples)
+
+	n, err := tsc.MigrateSeries()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = tsc.MigrateSeries()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	assert.NoError(t, tsc.Insert(now, map[string]float64{"value": 3}, tags))
+
+	ts, err = tsc.AggregateSets(now, now, []string{"value"}, Exact(tags))
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+	assert.Equal(t, float64(4), ts.Sum("value"))
+
+	ts, err = tsc.AggregateSets(now, now, []string{"value"}, Exact(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), ts.Sum("value"))
+}
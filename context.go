@@ -0,0 +1,41 @@
+package mgots
+
+import (
+	"context"
+	"time"
+)
+
+func contextTimeout(ctx context.Context) (time.Duration, bool) {
+	// get deadline
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+
+	// get remaining time but at least a millisecond as zero disables timeouts
+	timeout := time.Until(deadline)
+	if timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+
+	return timeout, true
+}
+
+func contextError(ctx context.Context, err error, timeout bool) error {
+	// keep missing errors
+	if err == nil {
+		return nil
+	}
+
+	// prefer context error
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// map timeouts that have been enforced on behalf of the deadline
+	if _, ok := ctx.Deadline(); ok && timeout {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
@@ -0,0 +1,124 @@
+package mgots
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// StreamOptions configure the aggregation behind a Cursor.
+type StreamOptions struct {
+	// Whether the aggregation may write temporary files when it exceeds the
+	// memory limit of the server.
+	AllowDiskUse bool
+
+	// The number of samples fetched per batch. Zero uses the default of the
+	// server.
+	BatchSize int
+}
+
+// A Cursor streams aggregated samples one by one without loading the full
+// result into memory.
+type Cursor struct {
+	iter   Iterator
+	sample Sample
+	rates  func(Sample)
+}
+
+// Next will advance the cursor to the next sample and return whether one was
+// available. If it returns false, Err should be checked.
+func (c *Cursor) Next() bool {
+	// get next sample
+	if !c.iter.Next(&c.sample) {
+		c.sample = Sample{}
+		return false
+	}
+
+	// calculate rates
+	if c.rates != nil {
+		c.rates(c.sample)
+	}
+
+	return true
+}
+
+// Sample will return the current sample.
+func (c *Cursor) Sample() Sample {
+	return c.sample
+}
+
+// Err will return the error that stopped the cursor.
+func (c *Cursor) Err() error {
+	return c.iter.Err()
+}
+
+// Close will close the cursor and release the underlying resources.
+func (c *Cursor) Close() error {
+	return c.iter.Close()
+}
+
+// StreamSamples will aggregate all samples matching the specified time range
+// and tags like AggregateSamples but return a cursor that yields the samples
+// in order. The cursor must be closed when no longer needed.
+func (c *Collection) StreamSamples(first, last time.Time, metrics []string, tags bson.M, opts StreamOptions) (*Cursor, error) {
+	return c.StreamSamplesContext(context.Background(), first, last, metrics, tags, opts)
+}
+
+// StreamSamplesContext will aggregate all samples like StreamSamples but use
+// the specified context like AggregateSamplesContext. The context also applies
+// to the iteration of the returned cursor.
+func (c *Collection) StreamSamplesContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M, opts StreamOptions) (*Cursor, error) {
+	// prepare query
+	query, err := c.samplesQuery(ctx, first, last, 0, nil, metrics, tags, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// set options
+	query.AllowDiskUse = opts.AllowDiskUse
+	query.BatchSize = opts.BatchSize
+
+	// iterate samples
+	iter, err := c.backend.IterateSamples(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cursor{
+		iter: iter,
+		rates: func(sample Sample) {
+			c.calculateRates(sample, 0, nil)
+		},
+	}, nil
+}
+
+// StreamSets will aggregate only set level metrics matching the specified time
+// range and tags like AggregateSets but return a cursor that yields the
+// samples in order. The cursor must be closed when no longer needed.
+func (c *Collection) StreamSets(first, last time.Time, metrics []string, tags bson.M, opts StreamOptions) (*Cursor, error) {
+	return c.StreamSetsContext(context.Background(), first, last, metrics, tags, opts)
+}
+
+// StreamSetsContext will aggregate only set level metrics like StreamSets but
+// use the specified context like AggregateSamplesContext. The context also
+// applies to the iteration of the returned cursor.
+func (c *Collection) StreamSetsContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M, opts StreamOptions) (*Cursor, error) {
+	// prepare query
+	query, err := c.setsQuery(ctx, first, last, metrics, tags, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// set options
+	query.AllowDiskUse = opts.AllowDiskUse
+	query.BatchSize = opts.BatchSize
+
+	// iterate sets
+	iter, err := c.backend.IterateSets(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cursor{iter: iter}, nil
+}
@@ -0,0 +1,95 @@
+package mgots
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	testCursor(t, WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds))
+}
+
+func TestCursorMongo(t *testing.T) {
+	requireMongo(t)
+
+	testCursor(t, Wrap(db.C("test-coll-cursor"), OneMinuteOf60Seconds))
+}
+
+func TestCursorDriver(t *testing.T) {
+	requireMongo(t)
+
+	testCursor(t, WrapDriver(driverDB.Collection("test-driver-cursor"), OneMinuteOf60Seconds))
+}
+
+func testCursor(t *testing.T, tsc *Collection) {
+	now := parseTime("Jul 15 15:14:00")
+
+	bulk := tsc.Bulk()
+	for i := 0; i < 3; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{
+			"value": float64(i + 1),
+		}, bson.M{"server": "a"})
+	}
+	bulk.Insert(now.Add(time.Minute), map[string]float64{
+		"value": 4,
+	}, bson.M{"server": "a"})
+	assert.NoError(t, bulk.Run())
+
+	cursor, err := tsc.StreamSamples(now, now.Add(time.Minute), []string{"value"}, bson.M{"server": "a"}, StreamOptions{
+		AllowDiskUse: true,
+		BatchSize:    1,
+	})
+	assert.NoError(t, err)
+
+	var samples []Sample
+	for cursor.Next() {
+		samples = append(samples, cursor.Sample())
+	}
+	assert.NoError(t, cursor.Err())
+	assert.NoError(t, cursor.Close())
+
+	ts, err := tsc.AggregateSamples(now, now.Add(time.Minute), []string{"value"}, bson.M{"server": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, ts.Samples, samples)
+	assert.Len(t, samples, 4)
+	assert.Equal(t, float64(1), samples[0].Metrics["value"].Rate)
+
+	cursor, err = tsc.StreamSets(now, now.Add(time.Minute), []string{"value"}, nil, StreamOptions{})
+	assert.NoError(t, err)
+
+	samples = nil
+	for cursor.Next() {
+		samples = append(samples, cursor.Sample())
+	}
+	assert.NoError(t, cursor.Err())
+	assert.NoError(t, cursor.Close())
+
+	ts, err = tsc.AggregateSets(now, now.Add(time.Minute), []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, ts.Samples, samples)
+	assert.Len(t, samples, 2)
+	assert.Equal(t, float64(6), samples[0].Metrics["value"].Sum)
+
+	for _, batchSize := range []int{0, 1} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		cursor, err = tsc.StreamSamplesContext(ctx, now, now.Add(time.Minute), []string{"value"}, nil, StreamOptions{
+			BatchSize: batchSize,
+		})
+		assert.NoError(t, err)
+
+		assert.True(t, cursor.Next())
+		assert.True(t, now.Equal(cursor.Sample().Start))
+
+		cancel()
+
+		assert.False(t, cursor.Next())
+		assert.Equal(t, Sample{}, cursor.Sample())
+		assert.Equal(t, context.Canceled, cursor.Err())
+		assert.NoError(t, cursor.Close())
+	}
+}
@@ -0,0 +1,191 @@
+package mgots
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+var maxTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Metrics will return the sorted names of all metrics stored in sets within the
+// specified time range that match the specified tags. If first and last are
+// zero, all sets are considered.
+func (c *Collection) Metrics(first, last time.Time, tags bson.M) ([]string, error) {
+	return c.MetricsContext(context.Background(), first, last, tags)
+}
+
+// MetricsContext will return the same result as Metrics but use the specified
+// context like AggregateSamplesContext.
+func (c *Collection) MetricsContext(ctx context.Context, first, last time.Time, tags bson.M) ([]string, error) {
+	// get names
+	names, err := c.backend.Metrics(ctx, c.rangeQuery(first, last, tags))
+	if err != nil {
+		return nil, err
+	}
+
+	// sort names
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Series will return the distinct tags of all series that have sets within the
+// specified time range and match the specified tags. If first and last are
+// zero, all sets are considered. The series are sorted by their tags.
+func (c *Collection) Series(first, last time.Time, tags bson.M) ([]bson.M, error) {
+	return c.SeriesContext(context.Background(), first, last, tags)
+}
+
+// SeriesContext will return the same result as Series but use the specified
+// context like AggregateSamplesContext.
+func (c *Collection) SeriesContext(ctx context.Context, first, last time.Time, tags bson.M) ([]bson.M, error) {
+	// get series
+	list, err := c.backend.Series(ctx, c.rangeQuery(first, last, tags))
+	if err != nil {
+		return nil, err
+	}
+
+	// deduplicate series
+	index := map[string]bson.M{}
+	for _, series := range list {
+		if series == nil {
+			series = bson.M{}
+		}
+
+		index[tagsKey(series)] = series
+	}
+
+	// sort keys
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// collect series
+	series := make([]bson.M, 0, len(keys))
+	for _, key := range keys {
+		series = append(series, index[key])
+	}
+
+	return series, nil
+}
+
+// TagKeys will return the sorted distinct tag keys of all series that have
+// sets within the specified time range and match the specified tags. If first
+// and last are zero, all sets are considered.
+func (c *Collection) TagKeys(first, last time.Time, tags bson.M) ([]string, error) {
+	return c.TagKeysContext(context.Background(), first, last, tags)
+}
+
+// TagKeysContext will return the same result as TagKeys but use the specified
+// context like AggregateSamplesContext.
+func (c *Collection) TagKeysContext(ctx context.Context, first, last time.Time, tags bson.M) ([]string, error) {
+	// get keys
+	keys, err := c.backend.TagKeys(ctx, c.rangeQuery(first, last, tags))
+	if err != nil {
+		return nil, err
+	}
+
+	// sort keys
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// TagValues will return the distinct values of the specified tag key of all
+// series that have sets within the specified time range and match the
+// specified tags. If first and last are zero, all sets are considered. The
+// values are sorted by their type like in MongoDB and then by their value.
+// Numbers of different types that are equal are only returned once.
+func (c *Collection) TagValues(key string, first, last time.Time, tags bson.M) ([]interface{}, error) {
+	return c.TagValuesContext(context.Background(), key, first, last, tags)
+}
+
+// TagValuesContext will return the same result as TagValues but use the specified
+// context like AggregateSamplesContext.
+func (c *Collection) TagValuesContext(ctx context.Context, key string, first, last time.Time, tags bson.M) ([]interface{}, error) {
+	// get values
+	list, err := c.backend.TagValues(ctx, c.rangeQuery(first, last, tags), key)
+	if err != nil {
+		return nil, err
+	}
+
+	// sort values
+	sort.SliceStable(list, func(i, j int) bool {
+		return compareTagValues(list[i], list[j]) < 0
+	})
+
+	// deduplicate values
+	values := make([]interface{}, 0, len(list))
+	for _, value := range list {
+		if len(values) == 0 || !memoryEqual(values[len(values)-1], value) {
+			values = append(values, value)
+		}
+	}
+
+	return values, nil
+}
+
+func compareTagValues(a, b interface{}) int {
+	// compare types
+	if ra, rb := tagValueRank(a), tagValueRank(b); ra != rb {
+		return ra - rb
+	}
+
+	// compare values
+	if r := memoryCompare(a, b); r != 0 {
+		return r
+	}
+
+	// compare formatted values of other types
+	return strings.Compare(fmt.Sprintf("%#v", canonicalValue(a)), fmt.Sprintf("%#v", canonicalValue(b)))
+}
+
+func tagValueRank(value interface{}) int {
+	// rank types like the BSON sort order of MongoDB
+	switch value.(type) {
+	case nil:
+		return 0
+	case int, int32, int64, float32, float64:
+		return 1
+	case string:
+		return 2
+	case bson.M, bson.D, map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case []byte, bson.Binary:
+		return 5
+	case bson.ObjectId:
+		return 6
+	case bool:
+		return 7
+	case time.Time:
+		return 8
+	default:
+		return 9
+	}
+}
+
+func (c *Collection) rangeQuery(first, last time.Time, tags bson.M) Query {
+	// match all sets if the range is missing
+	if first.IsZero() && last.IsZero() {
+		return Query{
+			FirstSet: time.Time{},
+			LastSet:  maxTime,
+			Tags:     tags,
+		}
+	}
+
+	return Query{
+		FirstSet: c.res.SetTimestamp(first),
+		LastSet:  c.res.SetTimestamp(last),
+		Tags:     tags,
+	}
+}
@@ -0,0 +1,128 @@
+package mgots
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectionDiscovery(t *testing.T) {
+	testCollectionDiscovery(t, WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds))
+}
+
+func TestCollectionDiscoveryMongo(t *testing.T) {
+	requireMongo(t)
+
+	testCollectionDiscovery(t, Wrap(db.C("test-coll-discovery"), OneMinuteOf60Seconds))
+}
+
+func TestCollectionDiscoveryDriver(t *testing.T) {
+	requireMongo(t)
+
+	testCollectionDiscovery(t, WrapDriver(driverDB.Collection("test-driver-discovery"), OneMinuteOf60Seconds))
+}
+
+func testCollectionDiscovery(t *testing.T, tsc *Collection) {
+	now := parseTime("Jul 15 15:15:15")
+
+	bulk := tsc.Bulk()
+	bulk.Insert(now, map[string]float64{"value": 1}, bson.M{"host": "a", "region": "eu"})
+	bulk.Insert(now, map[string]float64{"value": 1}, bson.M{"host": "b", "region": "eu"})
+	bulk.Insert(now.Add(time.Minute), map[string]float64{"value": 1}, bson.M{"host": "a", "region": "eu"})
+	bulk.Insert(now.Add(time.Hour), map[string]float64{"value": 1}, bson.M{"host": "c", "region": "us", "rack": 7})
+	bulk.Insert(now.Add(time.Hour), map[string]float64{"value": 1}, nil)
+	assert.NoError(t, bulk.Run())
+
+	series, err := tsc.Series(now, now.Add(time.Minute), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []bson.M{
+		{"host": "a", "region": "eu"},
+		{"host": "b", "region": "eu"},
+	}, series)
+
+	series, err = tsc.Series(time.Time{}, time.Time{}, bson.M{"region": "us"})
+	assert.NoError(t, err)
+	assert.Equal(t, []bson.M{
+		{"host": "c", "rack": 7, "region": "us"},
+	}, series)
+
+	series, err = tsc.Series(now.Add(time.Hour), now.Add(time.Hour), nil)
+	assert.NoError(t, err)
+	assert.Len(t, series, 2)
+
+	keys, err := tsc.TagKeys(time.Time{}, time.Time{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"host", "rack", "region"}, keys)
+
+	keys, err = tsc.TagKeys(now, now, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"host", "region"}, keys)
+
+	values, err := tsc.TagValues("host", time.Time{}, time.Time{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", "b", "c"}, values)
+
+	values, err = tsc.TagValues("host", now, now.Add(time.Hour), bson.M{"region": "eu"})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", "b"}, values)
+
+	values, err = tsc.TagValues("rack", time.Time{}, time.Time{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{7}, values)
+
+	bulk = tsc.Bulk()
+	for _, port := range []interface{}{10, "http", 9, int64(10), 8.5, int64(80)} {
+		bulk.Insert(now.Add(2*time.Hour), map[string]float64{"value": 1}, bson.M{"port": port})
+	}
+	assert.NoError(t, bulk.Run())
+
+	values, err = tsc.TagValues("port", time.Time{}, time.Time{}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, values, 5)
+	assert.Equal(t, 8.5, values[0])
+	assert.Equal(t, 9, values[1])
+	assert.True(t, memoryEqual(10, values[2]))
+	assert.Equal(t, int64(80), values[3])
+	assert.Equal(t, "http", values[4])
+}
+
+func TestCollectionMetrics(t *testing.T) {
+	testCollectionMetrics(t, WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds))
+}
+
+func TestCollectionMetricsMongo(t *testing.T) {
+	requireMongo(t)
+
+	testCollectionMetrics(t, Wrap(db.C("test-coll-metrics"), OneMinuteOf60Seconds))
+}
+
+func TestCollectionMetricsDriver(t *testing.T) {
+	requireMongo(t)
+
+	testCollectionMetrics(t, WrapDriver(driverDB.Collection("test-driver-metrics"), OneMinuteOf60Seconds))
+}
+
+func testCollectionMetrics(t *testing.T, tsc *Collection) {
+	now := parseTime("Jul 15 15:15:15")
+
+	bulk := tsc.Bulk()
+	bulk.Insert(now, map[string]float64{"cpu": 1, "mem": 2}, bson.M{"host": "a"})
+	bulk.Insert(now, map[string]float64{"cpu": 1}, bson.M{"host": "b"})
+	bulk.InsertDistinct(now, map[string][]string{"users": {"x"}}, bson.M{"host": "b"})
+	bulk.Insert(now.Add(time.Hour), map[string]float64{"disk": 1}, bson.M{"host": "a"})
+	assert.NoError(t, bulk.Run())
+
+	names, err := tsc.Metrics(now, now, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpu", "mem", "users"}, names)
+
+	names, err = tsc.Metrics(time.Time{}, time.Time{}, bson.M{"host": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpu", "disk", "mem"}, names)
+
+	names, err = tsc.Metrics(now.Add(time.Hour), now.Add(time.Hour), bson.M{"host": "b"})
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
@@ -0,0 +1,440 @@
+package mgots
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	mongobson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type driverBackend struct {
+	coll *mongo.Collection
+}
+
+// WrapDriver will take a mongo.Collection from the official MongoDB driver and
+// return a Collection. The stored documents are identical to the ones written
+// by a Collection returned from Wrap.
+func WrapDriver(coll *mongo.Collection, res Resolution) *Collection {
+	return WrapBackend(&driverBackend{coll: coll}, res)
+}
+
+func (b *driverBackend) Upsert(ctx context.Context, upserts []Upsert) error {
+	// skip if there is nothing to do
+	if len(upserts) == 0 {
+		return nil
+	}
+
+	// use a simple upsert for a single operation
+	if len(upserts) == 1 {
+		_, err := b.coll.UpdateOne(ctx, driverValue(upserts[0].Query), driverValue(upserts[0].update()), options.Update().SetUpsert(true))
+		return driverError(ctx, err)
+	}
+
+	// prepare models
+	models := make([]mongo.WriteModel, 0, len(upserts))
+	for _, upsert := range upserts {
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(driverValue(upsert.Query)).SetUpdate(driverValue(upsert.update())).SetUpsert(true))
+	}
+
+	_, err := b.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return driverError(ctx, err)
+}
+
+func (b *driverBackend) AggregateSamples(ctx context.Context, query Query) ([]Sample, error) {
+	return b.aggregate(ctx, samplesPipeline(query), query)
+}
+
+func (b *driverBackend) AggregateSets(ctx context.Context, query Query) ([]Sample, error) {
+	return b.aggregate(ctx, setsPipeline(query), query)
+}
+
+func (b *driverBackend) IterateSamples(ctx context.Context, query Query) (Iterator, error) {
+	return b.iterate(ctx, samplesPipeline(query), query)
+}
+
+func (b *driverBackend) IterateSets(ctx context.Context, query Query) (Iterator, error) {
+	return b.iterate(ctx, setsPipeline(query), query)
+}
+
+func (b *driverBackend) iterate(ctx context.Context, pipeline []bson.M, query Query) (Iterator, error) {
+	// run aggregation
+	cursor, err := b.coll.Aggregate(ctx, driverValue(pipeline), aggregateOptions(ctx, query))
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	return &driverIterator{ctx: ctx, cursor: cursor}, nil
+}
+
+func (b *driverBackend) aggregate(ctx context.Context, pipeline []bson.M, query Query) ([]Sample, error) {
+	// run aggregation
+	cursor, err := b.coll.Aggregate(ctx, driverValue(pipeline), aggregateOptions(ctx, query))
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	// fetch result, decoded like mgo to keep the tag value types identical
+	var samples []pipelineSample
+	err = driverAll(ctx, cursor, func(data []byte) error {
+		var ps pipelineSample
+		err := bson.Unmarshal(data, &ps)
+		samples = append(samples, ps)
+		return err
+	})
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	return pipelineSamples(samples), nil
+}
+
+func (b *driverBackend) Starts(ctx context.Context, query Query, limit int) ([]time.Time, error) {
+	// run aggregation
+	cursor, err := b.coll.Aggregate(ctx, driverValue(startsPipeline(query, limit)), aggregateOptions(ctx, query))
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	// fetch result
+	var starts []pipelineStart
+	err = cursor.All(ctx, &starts)
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	return pipelineStarts(starts), nil
+}
+
+func (b *driverBackend) Metrics(ctx context.Context, query Query) ([]string, error) {
+	// run aggregation
+	cursor, err := b.coll.Aggregate(ctx, driverValue(metricsPipeline(query)), aggregateOptions(ctx, query))
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	// fetch result
+	var names []pipelineName
+	err = cursor.All(ctx, &names)
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	return pipelineNames(names), nil
+}
+
+func (b *driverBackend) Series(ctx context.Context, query Query) ([]bson.M, error) {
+	// run aggregation
+	cursor, err := b.coll.Aggregate(ctx, driverValue(seriesPipeline(query)), aggregateOptions(ctx, query))
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	// fetch result
+	var series []pipelineSeries
+	err = driverAll(ctx, cursor, func(data []byte) error {
+		var doc pipelineSeries
+		err := bson.Unmarshal(data, &doc)
+		series = append(series, doc)
+		return err
+	})
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	return pipelineSeriesTags(series), nil
+}
+
+func (b *driverBackend) TagKeys(ctx context.Context, query Query) ([]string, error) {
+	// run aggregation
+	cursor, err := b.coll.Aggregate(ctx, driverValue(tagKeysPipeline(query)), aggregateOptions(ctx, query))
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	// fetch result
+	var keys []pipelineName
+	err = cursor.All(ctx, &keys)
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	return pipelineNames(keys), nil
+}
+
+func (b *driverBackend) TagValues(ctx context.Context, query Query, key string) ([]interface{}, error) {
+	// get distinct values
+	list, err := b.coll.Distinct(ctx, "tags."+key, driverValue(matchSets(query)))
+	if err != nil {
+		return nil, driverError(ctx, err)
+	}
+
+	// convert values
+	values := make([]interface{}, 0, len(list))
+	for _, value := range list {
+		// re-encode value
+		data, err := mongobson.Marshal(mongobson.D{{Key: "v", Value: value}})
+		if err != nil {
+			return nil, err
+		}
+
+		// decode value
+		var doc struct {
+			V interface{} `bson:"v"`
+		}
+		err = bson.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, doc.V)
+	}
+
+	return values, nil
+}
+
+func (b *driverBackend) Update(ctx context.Context, query Query, pipeline []bson.M) error {
+	// update sets
+	_, err := b.coll.UpdateMany(ctx, driverValue(matchSets(query)), driverValue(pipeline))
+
+	return driverError(ctx, err)
+}
+
+func (b *driverBackend) Remove(ctx context.Context, query Query) (int, error) {
+	// remove sets
+	res, err := b.coll.DeleteMany(ctx, driverValue(matchSets(query)))
+	if err != nil {
+		return 0, driverError(ctx, err)
+	}
+
+	return int(res.DeletedCount), nil
+}
+
+func (b *driverBackend) MigrateSeries(ctx context.Context, id func(tags bson.M) string) (int, error) {
+	// find sets without series
+	cursor, err := b.coll.Find(ctx, mongobson.M{
+		"series": mongobson.M{"$exists": false},
+	}, options.Find().SetProjection(mongobson.M{"tags": 1}))
+	if err != nil {
+		return 0, driverError(ctx, err)
+	}
+	defer cursor.Close(context.Background())
+
+	// prepare models
+	var models []mongo.WriteModel
+	var updated int
+
+	// queue updates
+	for cursor.Next(ctx) {
+		// decode tags like mgo
+		var set struct {
+			Tags bson.M `bson:"tags"`
+		}
+		err = bson.Unmarshal(cursor.Current, &set)
+		if err != nil {
+			return updated, err
+		}
+
+		// queue update
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(mongobson.M{"_id": cursor.Current.Lookup("_id")}).
+			SetUpdate(mongobson.M{"$set": mongobson.M{"series": id(set.Tags)}}))
+
+		// write full batch
+		if len(models) == 1000 {
+			_, err = b.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+			if err != nil {
+				return updated, driverError(ctx, err)
+			}
+
+			updated += len(models)
+			models = nil
+		}
+	}
+
+	// check error
+	err = cursor.Err()
+	if err != nil {
+		return updated, driverError(ctx, err)
+	}
+
+	// write remaining batch
+	if len(models) > 0 {
+		_, err = b.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return updated, driverError(ctx, err)
+		}
+
+		updated += len(models)
+	}
+
+	return updated, nil
+}
+
+func (b *driverBackend) EnsureIndexes(ctx context.Context, removeAfter time.Duration) error {
+	// prepare start index options
+	startOptions := options.Index().SetBackground(true)
+	if removeAfter > 0 {
+		// mimic mgo which rounds to seconds but expires after at least one
+		seconds := int32(removeAfter / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+
+		startOptions.SetExpireAfterSeconds(seconds)
+	}
+
+	// ensure indexes
+	_, err := b.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// start index
+		{
+			Keys:    mongobson.D{{Key: "start", Value: 1}},
+			Options: startOptions,
+		},
+		// tags index
+		{
+			Keys:    mongobson.D{{Key: "tags", Value: 1}},
+			Options: options.Index().SetBackground(true),
+		},
+		// start series index
+		{
+			Keys:    mongobson.D{{Key: "start", Value: 1}, {Key: "series", Value: 1}},
+			Options: options.Index().SetBackground(true),
+		},
+	})
+	if err != nil {
+		return driverError(ctx, err)
+	}
+
+	return nil
+}
+
+func driverAll(ctx context.Context, cursor *mongo.Cursor, fn func(data []byte) error) error {
+	// ensure cursor is closed
+	defer cursor.Close(context.Background())
+
+	// decode documents
+	for cursor.Next(ctx) {
+		err := fn(cursor.Current)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+type driverIterator struct {
+	ctx    context.Context
+	cursor *mongo.Cursor
+	err    error
+}
+
+func (i *driverIterator) Next(sample *Sample) bool {
+	// check context as the driver returns buffered documents without checking it
+	if i.ctx.Err() != nil {
+		i.err = i.ctx.Err()
+		return false
+	}
+
+	// get next document
+	if !i.cursor.Next(i.ctx) {
+		return false
+	}
+
+	// decode sample
+	var ps pipelineSample
+	err := bson.Unmarshal(i.cursor.Current, &ps)
+	if err != nil {
+		i.err = err
+		return false
+	}
+
+	// convert sample
+	*sample = ps.sample()
+
+	return true
+}
+
+func (i *driverIterator) Err() error {
+	// check context and decode error
+	if i.err != nil {
+		return i.err
+	}
+
+	return driverError(i.ctx, i.cursor.Err())
+}
+
+func (i *driverIterator) Close() error {
+	// close cursor even if the context has been cancelled
+	return i.cursor.Close(context.Background())
+}
+
+func aggregateOptions(ctx context.Context, query Query) *options.AggregateOptions {
+	// prepare options
+	opts := options.Aggregate()
+
+	// set options
+	if query.AllowDiskUse {
+		opts.SetAllowDiskUse(true)
+	}
+	if query.BatchSize > 0 {
+		opts.SetBatchSize(int32(query.BatchSize))
+	}
+
+	// set max time
+	if timeout, ok := contextTimeout(ctx); ok {
+		opts.SetMaxTime(timeout)
+	}
+
+	return opts
+}
+
+func driverError(ctx context.Context, err error) error {
+	return contextError(ctx, err, mongo.IsTimeout(err))
+}
+
+func driverValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		// convert documents recursively
+		doc := make(bson.M, len(v))
+		for key, val := range v {
+			doc[key] = driverValue(val)
+		}
+
+		return doc
+	case bson.D:
+		// convert ordered documents as the driver has its own type
+		doc := make(mongobson.D, 0, len(v))
+		for _, elem := range v {
+			doc = append(doc, mongobson.E{Key: elem.Name, Value: driverValue(elem.Value)})
+		}
+
+		return doc
+	case []bson.M:
+		// convert list of documents
+		list := make([]interface{}, 0, len(v))
+		for _, val := range v {
+			list = append(list, driverValue(val))
+		}
+
+		return list
+	case bson.RegEx:
+		// convert regular expressions
+		return primitive.Regex{Pattern: v.Pattern, Options: v.Options}
+	case []interface{}:
+		// convert lists recursively
+		list := make([]interface{}, 0, len(v))
+		for _, val := range v {
+			list = append(list, driverValue(val))
+		}
+
+		return list
+	}
+
+	return value
+}
@@ -0,0 +1,239 @@
+package mgots
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDriverInsert(t *testing.T) {
+	requireMongo(t)
+
+	tsc := WrapDriver(driverDB.Collection("test-driver-insert"), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	err := tsc.Insert(now, map[string]float64{
+		"value": 10.0,
+	}, nil)
+	assert.NoError(t, err)
+
+	var data []bson.M
+	err = db.C("test-driver-insert").Find(nil).Select(bson.M{"_id": 0}).All(&data)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []bson.M{
+		{
+			"num": bson.M{
+				"value": int(1),
+			},
+			"sum": bson.M{
+				"value": float64(10),
+			},
+			"max": bson.M{
+				"value": float64(10),
+			},
+			"min": bson.M{
+				"value": float64(10),
+			},
+			"sumsq": bson.M{
+				"value": float64(100),
+			},
+			"first": bson.M{
+				"value": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(10)},
+			},
+			"last": bson.M{
+				"value": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(10)},
+			},
+			"start":  parseTime("Jul 15 15:15:00"),
+			"series": SeriesID(nil),
+			"tags":   bson.M{},
+			"samples": bson.M{
+				"15": bson.M{
+					"start": parseTime("Jul 15 15:15:15"),
+					"value": bson.M{
+						"sum":   float64(10),
+						"num":   int(1),
+						"max":   float64(10),
+						"min":   float64(10),
+						"sumsq": float64(100),
+						"first": bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(10)},
+						"last":  bson.M{"t": parseTime("Jul 15 15:15:15"), "v": float64(10)},
+					},
+				},
+			},
+		},
+	}, forceUTCSlice(data))
+}
+
+func TestDriverAggregateSamples(t *testing.T) {
+	requireMongo(t)
+
+	tsc := WrapDriver(driverDB.Collection("test-driver-aggregate-samples"), OneMinuteOf60Seconds)
+
+	bulk := tsc.Bulk()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{
+			"value": float64(i),
+		}, bson.M{
+			"foo":  "bar",
+			"host": "one",
+		})
+	}
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{
+			"value": float64(10 + i),
+		}, bson.M{
+			"foo":  "bar",
+			"host": "two",
+		})
+	}
+
+	err := bulk.Run()
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSamples(now.Add(time.Second), now.Add(3*time.Second), []string{"value"}, bson.M{
+		"foo": "bar",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &TimeSeries{
+		Samples: []Sample{
+			{
+				Start: parseTime("Jul 15 15:15:16"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 11, Min: 1, Num: 2, Sum: 12, SumSq: 122, Rate: 12,
+						First: Point{Time: parseTime("Jul 15 15:15:16"), Value: 1},
+						Last:  Point{Time: parseTime("Jul 15 15:15:16"), Value: 11},
+					},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:15:17"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 12, Min: 2, Num: 2, Sum: 14, SumSq: 148, Rate: 14,
+						First: Point{Time: parseTime("Jul 15 15:15:17"), Value: 2},
+						Last:  Point{Time: parseTime("Jul 15 15:15:17"), Value: 12},
+					},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:15:18"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 13, Min: 3, Num: 2, Sum: 16, SumSq: 178, Rate: 16,
+						First: Point{Time: parseTime("Jul 15 15:15:18"), Value: 3},
+						Last:  Point{Time: parseTime("Jul 15 15:15:18"), Value: 13},
+					},
+				},
+			},
+		},
+	}, forceUTCTimeSeries(ts))
+}
+
+func TestDriverAggregateBy(t *testing.T) {
+	requireMongo(t)
+
+	testAggregateBy(t, WrapDriver(driverDB.Collection("test-driver-aggregate-by"), OneMinuteOf60Seconds))
+}
+
+func TestDriverAggregateSamplesStep(t *testing.T) {
+	requireMongo(t)
+
+	testAggregateSamplesStep(t, WrapDriver(driverDB.Collection("test-driver-aggregate-samples-step"), OneMinuteOf60Seconds))
+}
+
+func TestDriverAggregateSamplesStepIn(t *testing.T) {
+	requireMongo(t)
+
+	loc, err := time.LoadLocation("Europe/Zurich")
+	assert.NoError(t, err)
+
+	testAggregateSamplesStepIn(t, WrapDriver(driverDB.Collection("test-driver-aggregate-samples-step-in"), InLocation(OneDayOf24Hours, loc)), loc)
+}
+
+func TestDriverAggregateSets(t *testing.T) {
+	requireMongo(t)
+
+	tsc := WrapDriver(driverDB.Collection("test-driver-aggregate-sets"), OneMinuteOf60Seconds)
+
+	bulk := tsc.Bulk()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Minute), map[string]float64{
+			"value": float64(i),
+		}, bson.M{
+			"foo":  "bar",
+			"host": "one",
+		})
+	}
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Minute), map[string]float64{
+			"value": float64(10 + i),
+		}, bson.M{
+			"foo":  "bar",
+			"host": "two",
+		})
+	}
+
+	err := bulk.Run()
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSets(now.Add(time.Minute), now.Add(3*time.Minute), []string{"value"}, bson.M{
+		"foo": "bar",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &TimeSeries{
+		Samples: []Sample{
+			{
+				Start: parseTime("Jul 15 15:16:00"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 11, Min: 1, Num: 2, Sum: 12, SumSq: 122,
+						First: Point{Time: parseTime("Jul 15 15:16:15"), Value: 1},
+						Last:  Point{Time: parseTime("Jul 15 15:16:15"), Value: 11},
+					},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:17:00"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 12, Min: 2, Num: 2, Sum: 14, SumSq: 148,
+						First: Point{Time: parseTime("Jul 15 15:17:15"), Value: 2},
+						Last:  Point{Time: parseTime("Jul 15 15:17:15"), Value: 12},
+					},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:18:00"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 13, Min: 3, Num: 2, Sum: 16, SumSq: 178,
+						First: Point{Time: parseTime("Jul 15 15:18:15"), Value: 3},
+						Last:  Point{Time: parseTime("Jul 15 15:18:15"), Value: 13},
+					},
+				},
+			},
+		},
+	}, forceUTCTimeSeries(ts))
+}
+
+func TestDriverEnsureIndexes(t *testing.T) {
+	requireMongo(t)
+
+	tsc := WrapDriver(driverDB.Collection("test-driver-ensure-indexes"), OneHourOf60Minutes)
+
+	assert.NoError(t, tsc.EnsureIndexes(0))
+	assert.NoError(t, tsc.EnsureIndexes(0))
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/globalsign/mgo/bson"
 )
 
+// The output is not verified as the example requires a MongoDB server.
 func Example() {
 	// get time series collection
 	coll := Wrap(db.C("metrics"), OneMinuteOf60Seconds)
@@ -43,6 +44,44 @@ func Example() {
 	fmt.Println(ts.Min("value"))
 	fmt.Println(ts.Max("value"))
 	fmt.Println(ts.Avg("value"))
+}
+
+func ExampleNewMemoryBackend() {
+	// get time series collection backed by memory
+	coll := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	// ensure indexes
+	err := coll.EnsureIndexes(0)
+	if err != nil {
+		panic(err)
+	}
+
+	// prepare tags
+	tags := bson.M{"server": "localhost"}
+
+	// add some metrics
+	from := time.Now()
+	to := time.Now()
+	for i := 0; i < 100; i++ {
+		coll.Insert(to, map[string]float64{
+			"value": float64(i),
+		}, tags)
+
+		to = to.Add(time.Second)
+	}
+
+	// get data
+	ts, err := coll.AggregateSamples(from, to, []string{"value"}, tags)
+	if err != nil {
+		panic(err)
+	}
+
+	// print
+	fmt.Println(ts.Num("value"))
+	fmt.Println(ts.Sum("value"))
+	fmt.Println(ts.Min("value"))
+	fmt.Println(ts.Max("value"))
+	fmt.Println(ts.Avg("value"))
 
 	// Output:
 	// 100
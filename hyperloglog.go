@@ -0,0 +1,100 @@
+package mgots
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// HyperLogLogPrecision is the number of bits used to select a register. It
+// results in 1024 registers and a standard error of about 3.25%.
+const HyperLogLogPrecision = 10
+
+const hyperLogLogRegisters = 1 << HyperLogLogPrecision
+
+// A HyperLogLog is a mergeable cardinality estimator. Only non-empty registers
+// are stored, keyed by their index.
+type HyperLogLog map[string]int
+
+func newHyperLogLog(values []string) HyperLogLog {
+	// prepare registers
+	hll := make(HyperLogLog, len(values))
+
+	// add values
+	for _, value := range values {
+		index, rank := hyperLogLogRegister(value)
+		if rank > hll[index] {
+			hll[index] = rank
+		}
+	}
+
+	return hll
+}
+
+// Estimate returns the estimated number of distinct values.
+func (h HyperLogLog) Estimate() float64 {
+	// check registers
+	if len(h) == 0 {
+		return 0
+	}
+
+	// calculate harmonic sum, empty registers count as one
+	m := float64(hyperLogLogRegisters)
+	sum := m - float64(len(h))
+	for _, rank := range h {
+		sum += math.Pow(2, -float64(rank))
+	}
+
+	// calculate raw estimate
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// use linear counting for small cardinalities
+	zeros := m - float64(len(h))
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/zeros)
+	}
+
+	return estimate
+}
+
+func (h HyperLogLog) merge(other HyperLogLog) HyperLogLog {
+	// check registers
+	if h == nil && other == nil {
+		return nil
+	}
+
+	// merge registers
+	merged := make(HyperLogLog, len(h)+len(other))
+	for index, rank := range h {
+		merged[index] = rank
+	}
+	for index, rank := range other {
+		if rank > merged[index] {
+			merged[index] = rank
+		}
+	}
+
+	return merged
+}
+
+func hyperLogLogRegister(value string) (string, int) {
+	// hash value
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(value))
+	x := hash.Sum64()
+
+	// improve distribution of bits (murmur3 finalizer)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	// get register index and rank of remaining bits
+	index := x >> (64 - HyperLogLogPrecision)
+	rank := bits.LeadingZeros64(x<<HyperLogLogPrecision|1<<(HyperLogLogPrecision-1)) + 1
+
+	return strconv.FormatUint(index, 10), rank
+}
@@ -0,0 +1,34 @@
+package mgots
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	assert.Equal(t, float64(0), HyperLogLog(nil).Estimate())
+
+	for _, n := range []int{10, 100, 1000, 10000, 100000} {
+		values := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			values = append(values, "user-"+strconv.Itoa(i))
+		}
+
+		hll := newHyperLogLog(values)
+		assert.InEpsilon(t, float64(n), hll.Estimate(), 0.1, "%d", n)
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 1000; i++ {
+		a = append(a, "user-"+strconv.Itoa(i))
+		b = append(b, "user-"+strconv.Itoa(i+500))
+	}
+
+	hll := newHyperLogLog(a).merge(newHyperLogLog(b))
+	assert.InEpsilon(t, float64(1500), hll.Estimate(), 0.1)
+	assert.Equal(t, newHyperLogLog(append(a, b...)), hll)
+}
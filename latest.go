@@ -0,0 +1,128 @@
+package mgots
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Latest will return the most recent sample that contains at least one of the
+// specified metrics. The samples of all series matching the specified tags are
+// merged like in AggregateSamples. It will return nil if no sample exists.
+func (c *Collection) Latest(metrics []string, tags bson.M) (*Sample, error) {
+	return c.LatestContext(context.Background(), metrics, tags)
+}
+
+// LatestContext will return the most recent sample like Latest but use the
+// specified context like AggregateSamplesContext.
+func (c *Collection) LatestContext(ctx context.Context, metrics []string, tags bson.M) (*Sample, error) {
+	// get last sample
+	ts, err := c.LastNContext(ctx, 1, metrics, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	// check samples
+	if len(ts.Samples) == 0 {
+		return nil, nil
+	}
+
+	return &ts.Samples[0], nil
+}
+
+// LastN will return the n most recent samples that contain at least one of the
+// specified metrics sorted by their start. The samples of all series matching
+// the specified tags are merged like in AggregateSamples. The sets are walked
+// backwards by their start which does not require a time range.
+func (c *Collection) LastN(n int, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.LastNContext(context.Background(), n, metrics, tags)
+}
+
+// LastNContext will return the n most recent samples like LastN but use the
+// specified context like AggregateSamplesContext.
+func (c *Collection) LastNContext(ctx context.Context, n int, metrics []string, tags bson.M) (*TimeSeries, error) {
+	// prepare query
+	query := Query{
+		FirstSet: time.Time{},
+		LastSet:  maxTime,
+		Metrics:  metrics,
+		Tags:     tags,
+	}
+
+	// expand wildcard
+	err := c.expandMetrics(ctx, &query)
+	if err != nil {
+		return nil, err
+	}
+
+	// check arguments
+	if n <= 0 || len(query.Metrics) == 0 {
+		return &TimeSeries{}, nil
+	}
+
+	// collect samples backwards
+	var samples []Sample
+	for len(samples) < n {
+		// get starts of the most recent sets, every set yields at least one
+		// sample that contains one of the metrics
+		starts, err := c.backend.Starts(ctx, query, n-len(samples))
+		if err != nil {
+			return nil, err
+		}
+
+		// check starts
+		if len(starts) == 0 {
+			break
+		}
+
+		// get range
+		firstSet := starts[len(starts)-1]
+		lastSet := starts[0]
+
+		// aggregate samples of sets
+		list, err := c.backend.AggregateSamples(ctx, Query{
+			FirstSet:    firstSet,
+			LastSet:     lastSet,
+			FirstSample: firstSet,
+			LastSample:  maxTime,
+			Metrics:     query.Metrics,
+			Tags:        tags,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// add non-empty samples backwards
+		for i := len(list) - 1; i >= 0 && len(samples) < n; i-- {
+			if !sampleContains(list[i], query.Metrics) {
+				continue
+			}
+
+			c.calculateRates(list[i], 0, nil)
+			samples = append(samples, list[i])
+		}
+
+		// continue before the oldest set
+		query.LastSet = firstSet.Add(-time.Nanosecond)
+	}
+
+	// reverse samples
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+
+	return &TimeSeries{samples}, nil
+}
+
+func sampleContains(sample Sample, metrics []string) bool {
+	// check metrics
+	for _, name := range metrics {
+		metric := sample.Metrics[name]
+		if metric.Num > 0 || len(metric.HLL) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
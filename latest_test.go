@@ -0,0 +1,74 @@
+package mgots
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatest(t *testing.T) {
+	testLatest(t, WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds))
+}
+
+func TestLatestMongo(t *testing.T) {
+	requireMongo(t)
+
+	testLatest(t, Wrap(db.C("test-coll-latest"), OneMinuteOf60Seconds))
+}
+
+func TestLatestDriver(t *testing.T) {
+	requireMongo(t)
+
+	testLatest(t, WrapDriver(driverDB.Collection("test-driver-latest"), OneMinuteOf60Seconds))
+}
+
+func testLatest(t *testing.T, tsc *Collection) {
+	now := parseTime("Jul 15 15:14:00")
+
+	sample, err := tsc.Latest([]string{"cpu"}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, sample)
+
+	bulk := tsc.Bulk()
+	for i := 0; i < 3; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Minute), map[string]float64{
+			"cpu": float64(i),
+		}, bson.M{"server": "a"})
+		bulk.Insert(now.Add(time.Duration(i)*time.Minute+time.Second), map[string]float64{
+			"cpu": float64(i),
+		}, bson.M{"server": "b"})
+	}
+	bulk.Insert(now.Add(time.Hour), map[string]float64{
+		"mem": 1,
+	}, bson.M{"server": "a"})
+	assert.NoError(t, bulk.Run())
+
+	sample, err = tsc.Latest([]string{"cpu"}, bson.M{"server": "a"})
+	assert.NoError(t, err)
+	assert.True(t, now.Add(2*time.Minute).Equal(sample.Start))
+	assert.Equal(t, float64(2), sample.Metrics["cpu"].Last.Value)
+
+	ts, err := tsc.LastN(3, []string{"cpu"}, bson.M{"server": "a"})
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 3)
+	assert.True(t, now.Equal(ts.Samples[0].Start))
+	assert.True(t, now.Add(2*time.Minute).Equal(ts.Samples[2].Start))
+
+	ts, err = tsc.LastN(4, []string{"cpu"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 4)
+	assert.True(t, now.Add(time.Minute).Equal(ts.Samples[0].Start))
+	assert.True(t, now.Add(2*time.Minute+time.Second).Equal(ts.Samples[3].Start))
+	assert.Equal(t, float64(2), ts.Samples[2].Metrics["cpu"].Sum)
+
+	ts, err = tsc.LastN(10, []string{"cpu", "mem"}, bson.M{"server": "a"})
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 4)
+	assert.True(t, now.Add(time.Hour).Equal(ts.Samples[3].Start))
+
+	ts, err = tsc.LastN(0, []string{"cpu"}, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, ts.Samples)
+}
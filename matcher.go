@@ -0,0 +1,94 @@
+package mgots
+
+import "github.com/globalsign/mgo/bson"
+
+// Or can be used as a key in query tags to match series that match any of the
+// specified tags:
+//
+//	bson.M{Or: []bson.M{{"env": "prod"}, {"env": "staging"}}}
+const Or = "$or"
+
+const seriesKey = "$series"
+
+// A Matcher can be used as a value in query tags to match tags using an
+// operator other than equality:
+//
+//	bson.M{"server": Regex("^web-"), "env": NotEqual("staging")}
+type Matcher struct {
+	operator string
+	value    interface{}
+}
+
+// NotEqual will return a matcher that matches tags that are missing or not
+// equal to the specified value.
+func NotEqual(value interface{}) Matcher {
+	return Matcher{operator: "$ne", value: value}
+}
+
+// Regex will return a matcher that matches string tags using the specified
+// regular expression.
+func Regex(pattern string) Matcher {
+	return Matcher{operator: "$regex", value: pattern}
+}
+
+// In will return a matcher that matches tags that are equal to one of the
+// specified values.
+func In(values ...interface{}) Matcher {
+	return Matcher{operator: "$in", value: values}
+}
+
+// Exists will return a matcher that matches series that have the tag.
+func Exists() Matcher {
+	return Matcher{operator: "$exists", value: true}
+}
+
+// Missing will return a matcher that matches series that do not have the tag.
+func Missing() Matcher {
+	return Matcher{operator: "$exists", value: false}
+}
+
+func (m Matcher) query() interface{} {
+	// use native regular expression
+	if m.operator == "$regex" {
+		return bson.RegEx{Pattern: m.value.(string)}
+	}
+
+	return bson.M{m.operator: m.value}
+}
+
+func matchTags(tags bson.M) bson.M {
+	// prepare matcher
+	match := bson.M{}
+
+	// add tags
+	for key, value := range tags {
+		// add alternatives
+		if key == Or {
+			groups, _ := value.([]bson.M)
+			list := make([]bson.M, 0, len(groups))
+			for _, group := range groups {
+				list = append(list, matchTags(group))
+			}
+
+			match["$or"] = list
+
+			continue
+		}
+
+		// add series
+		if key == seriesKey {
+			match["series"] = value
+			continue
+		}
+
+		// add matcher
+		if matcher, ok := value.(Matcher); ok {
+			match["tags."+key] = matcher.query()
+			continue
+		}
+
+		match["tags."+key] = value
+	}
+
+	return match
+}
@@ -0,0 +1,34 @@
+package mgots
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTags(t *testing.T) {
+	assert.Equal(t, bson.M{
+		"tags.server": bson.RegEx{Pattern: "^web-"},
+		"tags.env":    bson.M{"$ne": "staging"},
+		"tags.zone":   bson.M{"$in": []interface{}{"a", "b"}},
+		"tags.rack":   bson.M{"$exists": true},
+		"tags.old":    bson.M{"$exists": false},
+		"tags.foo":    "bar",
+		"$or": []bson.M{
+			{"tags.region": "eu"},
+			{"tags.region": bson.M{"$exists": false}},
+		},
+	}, matchTags(bson.M{
+		"server": Regex("^web-"),
+		"env":    NotEqual("staging"),
+		"zone":   In("a", "b"),
+		"rack":   Exists(),
+		"old":    Missing(),
+		"foo":    "bar",
+		Or: []bson.M{
+			{"region": "eu"},
+			{"region": Missing()},
+		},
+	}))
+}
@@ -0,0 +1,1385 @@
+package mgots
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// A MemoryBackend is a Backend that keeps all sets in memory. It applies
+// updates with the same semantics as MongoDB and is mainly intended for tests
+// and local tools. The context of an operation is only checked before the
+// operation runs and between the samples yielded by an iterator.
+type MemoryBackend struct {
+	sets        []bson.M
+	removeAfter time.Duration
+	mutex       sync.Mutex
+}
+
+// NewMemoryBackend will return a new and empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+// Upsert implements the Backend interface.
+func (b *MemoryBackend) Upsert(ctx context.Context, upserts []Upsert) error {
+	// check context
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// remove expired sets
+	b.expire()
+
+	for _, upsert := range upserts {
+		// find existing set
+		var set bson.M
+		for _, s := range b.sets {
+			if memoryMatch(s, upsert.Query) {
+				set = s
+				break
+			}
+		}
+
+		// create set from query if missing
+		inserted := set == nil
+		if inserted {
+			set = bson.M{}
+			for path, value := range upsert.Query {
+				memorySet(set, path, memoryCopy(value))
+			}
+
+			b.sets = append(b.sets, set)
+		}
+
+		// apply pipeline or update
+		var err error
+		if upsert.Pipeline != nil {
+			err = memoryPipelineUpdate(set, upsert.Pipeline)
+		} else {
+			err = memoryUpdate(set, upsert.Update, inserted)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AggregateSamples implements the Backend interface.
+func (b *MemoryBackend) AggregateSamples(ctx context.Context, query Query) ([]Sample, error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// remove expired sets
+	b.expire()
+
+	// prepare groups
+	groups := newMemoryGroups(query.Metrics, query.GroupBy)
+
+	for _, set := range b.sets {
+		// check set
+		if !memoryMatchSet(set, query) {
+			continue
+		}
+
+		// get samples
+		samples, _ := set["samples"].(bson.M)
+
+		for _, value := range samples {
+			// get sample and start
+			sample, _ := value.(bson.M)
+			start, _ := sample["start"].(time.Time)
+
+			// match the exact time range
+			if start.Before(query.FirstSample) || start.After(query.LastSample) {
+				continue
+			}
+
+			// get bucket
+			if query.Step > 0 {
+				start = memoryBucket(start, query.Step, query.Location)
+			}
+
+			// add sample
+			groups.add(start, set, func(name, field string) (interface{}, bool) {
+				return memoryGet(sample, name+"."+field)
+			})
+		}
+	}
+
+	return groups.samples(), nil
+}
+
+// AggregateSets implements the Backend interface.
+func (b *MemoryBackend) AggregateSets(ctx context.Context, query Query) ([]Sample, error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// remove expired sets
+	b.expire()
+
+	// prepare groups
+	groups := newMemoryGroups(query.Metrics, query.GroupBy)
+
+	for _, set := range b.sets {
+		// check set
+		if !memoryMatchSet(set, query) {
+			continue
+		}
+
+		// add set
+		start, _ := set["start"].(time.Time)
+		groups.add(start, set, func(name, field string) (interface{}, bool) {
+			return memoryGet(set, field+"."+name)
+		})
+	}
+
+	return groups.samples(), nil
+}
+
+// IterateSamples implements the Backend interface.
+func (b *MemoryBackend) IterateSamples(ctx context.Context, query Query) (Iterator, error) {
+	// aggregate samples
+	samples, err := b.AggregateSamples(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryIterator{ctx: ctx, samples: samples}, nil
+}
+
+// IterateSets implements the Backend interface.
+func (b *MemoryBackend) IterateSets(ctx context.Context, query Query) (Iterator, error) {
+	// aggregate sets
+	samples, err := b.AggregateSets(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryIterator{ctx: ctx, samples: samples}, nil
+}
+
+// Starts implements the Backend interface.
+func (b *MemoryBackend) Starts(ctx context.Context, query Query, limit int) ([]time.Time, error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// expire sets
+	b.expire()
+
+	// collect starts of matching sets with one of the metrics
+	index := map[int64]bool{}
+	var starts []time.Time
+	for _, set := range b.sets {
+		if !memoryMatchSet(set, query) {
+			continue
+		}
+
+		var found bool
+		for _, name := range query.Metrics {
+			num, _ := memoryGet(set, "num."+name)
+			_, hll := memoryGet(set, "hll."+name)
+			if memoryFloat(num) > 0 || hll {
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+
+		start, _ := set["start"].(time.Time)
+		if !index[start.UnixNano()] {
+			index[start.UnixNano()] = true
+			starts = append(starts, start)
+		}
+	}
+
+	// sort starts backwards
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].After(starts[j])
+	})
+
+	// limit starts
+	if len(starts) > limit {
+		starts = starts[:limit]
+	}
+
+	return starts, nil
+}
+
+// Metrics implements the Backend interface.
+func (b *MemoryBackend) Metrics(ctx context.Context, query Query) ([]string, error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// expire sets
+	b.expire()
+
+	// collect names of counted and distinct metrics
+	index := map[string]bool{}
+	var names []string
+	for _, set := range b.sets {
+		if !memoryMatchSet(set, query) {
+			continue
+		}
+
+		for _, field := range []string{"num", "hll"} {
+			metrics, _ := set[field].(bson.M)
+			for name := range metrics {
+				if !index[name] {
+					index[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// Series implements the Backend interface.
+func (b *MemoryBackend) Series(ctx context.Context, query Query) ([]bson.M, error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// expire sets
+	b.expire()
+
+	// collect tags of matching series
+	index := map[interface{}]bool{}
+	var series []bson.M
+	for _, set := range b.sets {
+		if memoryMatchSet(set, query) && !index[set["series"]] {
+			index[set["series"]] = true
+			tags, _ := set["tags"].(bson.M)
+			series = append(series, memoryCopy(tags).(bson.M))
+		}
+	}
+
+	return series, nil
+}
+
+// TagKeys implements the Backend interface.
+func (b *MemoryBackend) TagKeys(ctx context.Context, query Query) ([]string, error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// expire sets
+	b.expire()
+
+	// collect keys of matching sets
+	index := map[string]bool{}
+	var keys []string
+	for _, set := range b.sets {
+		if !memoryMatchSet(set, query) {
+			continue
+		}
+
+		tags, _ := set["tags"].(bson.M)
+		for key := range tags {
+			if !index[key] {
+				index[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// TagValues implements the Backend interface.
+func (b *MemoryBackend) TagValues(ctx context.Context, query Query, key string) ([]interface{}, error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// expire sets
+	b.expire()
+
+	// collect values of matching sets
+	var values []interface{}
+	for _, set := range b.sets {
+		if !memoryMatchSet(set, query) {
+			continue
+		}
+
+		value, ok := memoryGet(set, "tags."+key)
+		if !ok {
+			continue
+		}
+
+		var found bool
+		for _, v := range values {
+			if memoryEqual(v, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, memoryCopy(value))
+		}
+	}
+
+	return values, nil
+}
+
+// Update implements the Backend interface.
+func (b *MemoryBackend) Update(ctx context.Context, query Query, pipeline []bson.M) error {
+	// check context
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// expire sets
+	b.expire()
+
+	// update matching sets
+	for _, set := range b.sets {
+		if memoryMatchSet(set, query) {
+			err := memoryPipelineUpdate(set, pipeline)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// MigrateSeries implements the Backend interface.
+func (b *MemoryBackend) MigrateSeries(ctx context.Context, id func(tags bson.M) string) (int, error) {
+	// check context
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// expire sets
+	b.expire()
+
+	// set missing series
+	var updated int
+	for _, set := range b.sets {
+		if _, ok := set["series"]; !ok {
+			tags, _ := set["tags"].(bson.M)
+			set["series"] = id(tags)
+			updated++
+		}
+	}
+
+	return updated, nil
+}
+
+// Remove implements the Backend interface.
+func (b *MemoryBackend) Remove(ctx context.Context, query Query) (int, error) {
+	// check context
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// expire sets
+	b.expire()
+
+	// keep all sets that do not match
+	sets := b.sets[:0]
+	for _, set := range b.sets {
+		if !memoryMatchSet(set, query) {
+			sets = append(sets, set)
+		}
+	}
+
+	// get count
+	removed := len(b.sets) - len(sets)
+
+	// clear removed sets
+	for i := len(sets); i < len(b.sets); i++ {
+		b.sets[i] = nil
+	}
+
+	b.sets = sets
+
+	return removed, nil
+}
+
+// EnsureIndexes implements the Backend interface.
+func (b *MemoryBackend) EnsureIndexes(ctx context.Context, removeAfter time.Duration) error {
+	// check context
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// set removal duration
+	b.removeAfter = removeAfter
+
+	return nil
+}
+
+func (b *MemoryBackend) expire() {
+	// check duration
+	if b.removeAfter <= 0 {
+		return
+	}
+
+	// get threshold
+	threshold := time.Now().Add(-b.removeAfter)
+
+	// keep all sets that have not yet expired
+	sets := b.sets[:0]
+	for _, set := range b.sets {
+		start, _ := set["start"].(time.Time)
+		if !start.Before(threshold) {
+			sets = append(sets, set)
+		}
+	}
+
+	b.sets = sets
+}
+
+type memoryMetric struct {
+	Metric
+	hasMax bool
+	hasMin bool
+}
+
+type memoryIterator struct {
+	ctx     context.Context
+	samples []Sample
+	err     error
+}
+
+func (i *memoryIterator) Next(sample *Sample) bool {
+	// check context
+	if i.ctx.Err() != nil {
+		i.err = i.ctx.Err()
+		return false
+	}
+
+	// check samples
+	if len(i.samples) == 0 {
+		return false
+	}
+
+	// pop sample
+	*sample = i.samples[0]
+	i.samples = i.samples[1:]
+
+	return true
+}
+
+func (i *memoryIterator) Err() error {
+	return i.err
+}
+
+func (i *memoryIterator) Close() error {
+	i.samples = nil
+	return nil
+}
+
+type memoryGroup struct {
+	start   time.Time
+	tags    bson.M
+	metrics map[string]*memoryMetric
+}
+
+type memoryGroups struct {
+	names  []string
+	keys   []string
+	groups map[string]*memoryGroup
+}
+
+func newMemoryGroups(names, keys []string) *memoryGroups {
+	return &memoryGroups{
+		names:  names,
+		keys:   keys,
+		groups: map[string]*memoryGroup{},
+	}
+}
+
+func (g *memoryGroups) add(start time.Time, set bson.M, lookup func(name, field string) (interface{}, bool)) {
+	// get grouped tags
+	var tags bson.M
+	if len(g.keys) > 0 {
+		tags = bson.M{}
+		for _, key := range g.keys {
+			if value, ok := memoryGet(set, "tags."+key); ok {
+				tags[key] = value
+			}
+		}
+	}
+
+	// get group
+	id := strconv.FormatInt(start.UnixNano(), 10) + "/" + tagsKey(tags)
+	group, ok := g.groups[id]
+	if !ok {
+		group = &memoryGroup{
+			start:   start,
+			tags:    tags,
+			metrics: map[string]*memoryMetric{},
+		}
+
+		for _, name := range g.names {
+			group.metrics[name] = &memoryMetric{}
+		}
+
+		g.groups[id] = group
+	}
+
+	// merge metrics
+	for _, name := range g.names {
+		metric := group.metrics[name]
+
+		if value, ok := lookup(name, "max"); ok {
+			max := memoryFloat(value)
+			if !metric.hasMax || max > metric.Max {
+				metric.Max = max
+				metric.hasMax = true
+			}
+		}
+
+		if value, ok := lookup(name, "min"); ok {
+			min := memoryFloat(value)
+			if !metric.hasMin || min < metric.Min {
+				metric.Min = min
+				metric.hasMin = true
+			}
+		}
+
+		if value, ok := lookup(name, "num"); ok {
+			metric.Num += int64(memoryFloat(value))
+		}
+
+		if value, ok := lookup(name, "sum"); ok {
+			metric.Sum += memoryFloat(value)
+		}
+
+		if value, ok := lookup(name, "sumsq"); ok {
+			metric.SumSq += memoryFloat(value)
+		}
+
+		if value, ok := lookup(name, "first"); ok {
+			metric.First = firstPoint(metric.First, memoryPoint(value))
+		}
+
+		if value, ok := lookup(name, "last"); ok {
+			metric.Last = lastPoint(metric.Last, memoryPoint(value))
+		}
+
+		if value, ok := lookup(name, "sketch"); ok {
+			metric.Sketch = metric.Sketch.merge(memorySketch(value))
+		}
+
+		if value, ok := lookup(name, "hll"); ok {
+			metric.HLL = metric.HLL.merge(memoryHyperLogLog(value))
+		}
+	}
+}
+
+func (g *memoryGroups) samples() []Sample {
+	// prepare samples
+	samples := make([]Sample, 0, len(g.groups))
+
+	// add samples
+	for _, group := range g.groups {
+		metrics := make(map[string]Metric, len(group.metrics))
+		for name, metric := range group.metrics {
+			metrics[name] = metric.Metric
+		}
+
+		samples = append(samples, Sample{
+			Start:   group.start,
+			Metrics: metrics,
+			Tags:    group.tags,
+		})
+	}
+
+	// sort samples
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Start.Equal(samples[j].Start) {
+			return tagsKey(samples[i].Tags) < tagsKey(samples[j].Tags)
+		}
+
+		return samples[i].Start.Before(samples[j].Start)
+	})
+
+	return samples
+}
+
+func memoryBucket(t time.Time, step time.Duration, loc *time.Location) time.Time {
+	// align to the Unix epoch if the location is missing
+	if loc == nil {
+		// get offset within bucket
+		offset := t.UnixNano() % int64(step)
+		if offset < 0 {
+			offset += int64(step)
+		}
+
+		return t.Add(-time.Duration(offset))
+	}
+
+	// get local time
+	local := t.In(loc)
+
+	// bucket multi-day steps by the number of local days since the epoch
+	if step >= 24*time.Hour {
+		days := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+		offset := int(days % int64(step/(24*time.Hour)))
+		return time.Date(local.Year(), local.Month(), local.Day()-offset, 0, 0, 0, 0, loc).In(t.Location())
+	}
+
+	// get local wall clock time of day truncated to milliseconds
+	wall := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second + time.Duration(local.Nanosecond()).Truncate(time.Millisecond)
+
+	// bucket sub-day steps by the local wall clock time
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, int(wall-wall%step), loc).In(t.Location())
+}
+
+func memoryMatchSet(set bson.M, query Query) bool {
+	// check start
+	start, _ := set["start"].(time.Time)
+	if start.Before(query.FirstSet) || start.After(query.LastSet) {
+		return false
+	}
+
+	// check tags
+	if !memoryMatchTags(set, query.Tags) {
+		return false
+	}
+
+	// check exclusions
+	for _, tags := range query.Exclude {
+		if memoryMatchTags(set, tags) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func memoryMatchTags(set, tags bson.M) bool {
+	for key, value := range tags {
+		// check alternatives
+		if key == Or {
+			groups, _ := value.([]bson.M)
+			matched := false
+			for _, group := range groups {
+				if memoryMatchTags(set, group) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+
+			continue
+		}
+
+		// check series
+		if key == seriesKey {
+			if !memoryEqual(set["series"], value) {
+				return false
+			}
+
+			continue
+		}
+
+		// get tag
+		tag, ok := memoryGet(set, "tags."+key)
+
+		// check matcher
+		if matcher, isMatcher := value.(Matcher); isMatcher {
+			if !memoryMatchTag(matcher, tag, ok) {
+				return false
+			}
+
+			continue
+		}
+
+		// check equality
+		if !memoryEqual(tag, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func memoryMatchTag(matcher Matcher, tag interface{}, ok bool) bool {
+	switch matcher.operator {
+	case "$ne":
+		return !ok || !memoryEqual(tag, matcher.value)
+	case "$regex":
+		str, isString := tag.(string)
+		if !isString {
+			return false
+		}
+		matched, _ := regexp.MatchString(matcher.value.(string), str)
+		return matched
+	case "$in":
+		for _, value := range matcher.value.([]interface{}) {
+			if ok && memoryEqual(tag, value) {
+				return true
+			}
+		}
+		return false
+	case "$exists":
+		return ok == matcher.value.(bool)
+	}
+
+	return false
+}
+
+func memoryMatch(doc, query bson.M) bool {
+	for path, value := range query {
+		field, _ := memoryGet(doc, path)
+		if !memoryEqual(field, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func memoryUpdate(doc, update bson.M, inserted bool) error {
+	for operator, fields := range update {
+		for path, value := range fields.(bson.M) {
+			// get current value
+			current, ok := memoryGet(doc, path)
+
+			switch operator {
+			case "$set":
+				memorySet(doc, path, memoryCopy(value))
+			case "$setOnInsert":
+				if inserted {
+					memorySet(doc, path, memoryCopy(value))
+				}
+			case "$inc":
+				if ok {
+					value = memoryAdd(current, value)
+				}
+
+				memorySet(doc, path, value)
+			case "$max":
+				if !ok || memoryCompare(value, current) > 0 {
+					memorySet(doc, path, memoryCopy(value))
+				}
+			case "$min":
+				if !ok || memoryCompare(value, current) < 0 {
+					memorySet(doc, path, memoryCopy(value))
+				}
+			default:
+				return fmt.Errorf("mgots: unsupported update operator %s", operator)
+			}
+		}
+	}
+
+	return nil
+}
+
+func memoryPipelineUpdate(doc bson.M, pipeline []bson.M) error {
+	for _, stage := range pipeline {
+		for operator, arg := range stage {
+			switch operator {
+			case "$set":
+				// evaluate all fields before setting them
+				fields := arg.(bson.M)
+				values := make(bson.M, len(fields))
+				for path, expr := range fields {
+					value, err := memoryEval(doc, nil, expr)
+					if err != nil {
+						return err
+					}
+
+					values[path] = value
+				}
+
+				// set fields
+				for path, value := range values {
+					memorySet(doc, path, value)
+				}
+			case "$unset":
+				// get paths
+				var paths []string
+				switch v := arg.(type) {
+				case string:
+					paths = []string{v}
+				case []string:
+					paths = v
+				}
+
+				// unset paths
+				for _, path := range paths {
+					memoryUnset(doc, path)
+				}
+			default:
+				return fmt.Errorf("mgots: unsupported pipeline stage %s", operator)
+			}
+		}
+	}
+
+	return nil
+}
+
+func memoryEval(doc bson.M, vars bson.M, expr interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		// handle variables
+		if strings.HasPrefix(e, "$$") {
+			value, _ := memoryGet(vars, e[2:])
+			return value, nil
+		}
+
+		// handle field paths
+		if strings.HasPrefix(e, "$") {
+			value, _ := memoryGet(doc, e[1:])
+			return value, nil
+		}
+
+		return e, nil
+	case bson.M:
+		// evaluate operators
+		for operator, arg := range e {
+			if strings.HasPrefix(operator, "$") {
+				return memoryOperator(doc, vars, operator, arg)
+			}
+		}
+
+		// evaluate documents
+		out := make(bson.M, len(e))
+		for key, value := range e {
+			result, err := memoryEval(doc, vars, value)
+			if err != nil {
+				return nil, err
+			}
+
+			out[key] = result
+		}
+
+		return out, nil
+	case []interface{}:
+		// evaluate lists
+		out := make([]interface{}, 0, len(e))
+		for _, value := range e {
+			result, err := memoryEval(doc, vars, value)
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, result)
+		}
+
+		return out, nil
+	}
+
+	return memoryCopy(expr), nil
+}
+
+func memoryOperator(doc bson.M, vars bson.M, operator string, arg interface{}) (interface{}, error) {
+	// handle literals
+	if operator == "$literal" {
+		return memoryCopy(arg), nil
+	}
+
+	// handle map and filter
+	if operator == "$map" || operator == "$filter" {
+		// get arguments
+		args, _ := arg.(bson.M)
+		name, _ := args["as"].(string)
+
+		// evaluate input
+		input, err := memoryEval(doc, vars, args["input"])
+		if err != nil {
+			return nil, err
+		}
+
+		// map or filter items
+		list, _ := input.([]interface{})
+		out := make([]interface{}, 0, len(list))
+		for _, item := range list {
+			// prepare variables
+			itemVars := memoryVars(vars, bson.M{name: item})
+
+			// filter item
+			if operator == "$filter" {
+				cond, err := memoryEval(doc, itemVars, args["cond"])
+				if err != nil {
+					return nil, err
+				}
+
+				if cond == true {
+					out = append(out, item)
+				}
+
+				continue
+			}
+
+			// evaluate item
+			result, err := memoryEval(doc, itemVars, args["in"])
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, result)
+		}
+
+		return out, nil
+	}
+
+	// handle let
+	if operator == "$let" {
+		// get arguments
+		args, _ := arg.(bson.M)
+		defs, _ := args["vars"].(bson.M)
+
+		// evaluate variables
+		values := bson.M{}
+		for name, def := range defs {
+			value, err := memoryEval(doc, vars, def)
+			if err != nil {
+				return nil, err
+			}
+
+			values[name] = value
+		}
+
+		return memoryEval(doc, memoryVars(vars, values), args["in"])
+	}
+
+	// evaluate argument
+	value, err := memoryEval(doc, vars, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case "$objectToArray":
+		// get sorted keys
+		obj, _ := value.(bson.M)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		// create pairs
+		out := make([]interface{}, 0, len(obj))
+		for _, key := range keys {
+			out = append(out, bson.M{"k": key, "v": obj[key]})
+		}
+
+		return out, nil
+	case "$arrayToObject":
+		// create object from pairs
+		list, _ := value.([]interface{})
+		out := make(bson.M, len(list))
+		for _, item := range list {
+			pair, _ := item.(bson.M)
+			key, _ := pair["k"].(string)
+			out[key] = pair["v"]
+		}
+
+		return out, nil
+	case "$arrayElemAt":
+		// get list and index
+		args, _ := value.([]interface{})
+		if len(args) != 2 {
+			return nil, fmt.Errorf("mgots: invalid arguments for %s", operator)
+		}
+		list, _ := args[0].([]interface{})
+		index := memoryFloat(args[1])
+
+		// get element
+		i := int(index)
+		if i < 0 {
+			i += len(list)
+		}
+		if i < 0 || i >= len(list) {
+			return nil, nil
+		}
+
+		return list[i], nil
+	case "$ifNull":
+		// get first non-null value
+		args, _ := value.([]interface{})
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+
+		return nil, nil
+	case "$eq":
+		// compare values
+		args, _ := value.([]interface{})
+		if len(args) != 2 {
+			return nil, fmt.Errorf("mgots: invalid arguments for %s", operator)
+		}
+
+		return memoryEqual(args[0], args[1]), nil
+	case "$sum":
+		// sum numbers and ignore other values
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+
+		var sum interface{} = 0
+		for _, item := range list {
+			if memoryNumber(item) {
+				sum = memoryAdd(sum, item)
+			}
+		}
+
+		return sum, nil
+	case "$max", "$min":
+		// find extreme and ignore missing values
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+
+		var result interface{}
+		for _, item := range list {
+			if item == nil {
+				continue
+			}
+
+			if result == nil {
+				result = item
+			} else if r := memoryCompare(item, result); (operator == "$max" && r > 0) || (operator == "$min" && r < 0) {
+				result = item
+			}
+		}
+
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("mgots: unsupported expression operator %s", operator)
+}
+
+func memoryVars(vars, values bson.M) bson.M {
+	// copy variables
+	out := make(bson.M, len(vars)+len(values))
+	for key, value := range vars {
+		out[key] = value
+	}
+
+	// add values
+	for key, value := range values {
+		out[key] = value
+	}
+
+	return out
+}
+
+func memoryGet(doc bson.M, path string) (interface{}, bool) {
+	// split path
+	segments := strings.Split(path, ".")
+
+	// walk documents
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := doc[segment].(bson.M)
+		if !ok {
+			return nil, false
+		}
+
+		doc = next
+	}
+
+	// get value
+	value, ok := doc[segments[len(segments)-1]]
+
+	return value, ok
+}
+
+func memorySet(doc bson.M, path string, value interface{}) {
+	// split path
+	segments := strings.Split(path, ".")
+
+	// walk and create documents
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := doc[segment].(bson.M)
+		if !ok {
+			next = bson.M{}
+			doc[segment] = next
+		}
+
+		doc = next
+	}
+
+	// set value
+	doc[segments[len(segments)-1]] = value
+}
+
+func memoryUnset(doc bson.M, path string) {
+	// split path
+	segments := strings.Split(path, ".")
+
+	// walk documents
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := doc[segment].(bson.M)
+		if !ok {
+			return
+		}
+
+		doc = next
+	}
+
+	// remove value
+	delete(doc, segments[len(segments)-1])
+}
+
+func memoryCopy(value interface{}) interface{} {
+	// copy documents recursively
+	if doc, ok := value.(bson.M); ok {
+		cpy := make(bson.M, len(doc))
+		for key, value := range doc {
+			cpy[key] = memoryCopy(value)
+		}
+
+		return cpy
+	}
+
+	// copy ordered documents recursively
+	if doc, ok := value.(bson.D); ok {
+		cpy := make(bson.D, 0, len(doc))
+		for _, elem := range doc {
+			cpy = append(cpy, bson.DocElem{Name: elem.Name, Value: memoryCopy(elem.Value)})
+		}
+
+		return cpy
+	}
+
+	return value
+}
+
+func memoryAdd(a, b interface{}) interface{} {
+	// keep integers if possible
+	ai, aok := a.(int)
+	bi, bok := b.(int)
+	if aok && bok {
+		return ai + bi
+	}
+
+	return memoryFloat(a) + memoryFloat(b)
+}
+
+func memoryFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case float64:
+		return v
+	}
+
+	return 0
+}
+
+func memoryPoint(value interface{}) Point {
+	// get point from ordered document
+	var point Point
+	doc, _ := value.(bson.D)
+	for _, elem := range doc {
+		switch elem.Name {
+		case "t":
+			point.Time, _ = elem.Value.(time.Time)
+		case "v":
+			point.Value = memoryFloat(elem.Value)
+		}
+	}
+
+	return point
+}
+
+func memorySketch(value interface{}) Sketch {
+	// get sketch from document
+	doc, _ := value.(bson.M)
+	sketch := make(Sketch, len(doc))
+	for key, count := range doc {
+		sketch[key] = int64(memoryFloat(count))
+	}
+
+	return sketch
+}
+
+func memoryHyperLogLog(value interface{}) HyperLogLog {
+	// get hyperloglog from document
+	doc, _ := value.(bson.M)
+	hll := make(HyperLogLog, len(doc))
+	for index, rank := range doc {
+		hll[index] = int(memoryFloat(rank))
+	}
+
+	return hll
+}
+
+func memoryNumber(value interface{}) bool {
+	switch value.(type) {
+	case int, int32, int64, float32, float64:
+		return true
+	}
+
+	return false
+}
+
+func memoryCompare(a, b interface{}) int {
+	// compare numbers
+	if memoryNumber(a) && memoryNumber(b) {
+		af, bf := memoryFloat(a), memoryFloat(b)
+		if af < bf {
+			return -1
+		} else if af > bf {
+			return 1
+		}
+
+		return 0
+	}
+
+	// compare times
+	at, aok := a.(time.Time)
+	bt, bok := b.(time.Time)
+	if aok && bok {
+		if at.Before(bt) {
+			return -1
+		} else if at.After(bt) {
+			return 1
+		}
+
+		return 0
+	}
+
+	// compare strings
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return strings.Compare(as, bs)
+	}
+
+	// compare ordered documents element by element
+	ad, aok := a.(bson.D)
+	bd, bok := b.(bson.D)
+	if aok && bok {
+		for i := 0; i < len(ad) && i < len(bd); i++ {
+			if r := strings.Compare(ad[i].Name, bd[i].Name); r != 0 {
+				return r
+			}
+
+			if r := memoryCompare(ad[i].Value, bd[i].Value); r != 0 {
+				return r
+			}
+		}
+
+		return len(ad) - len(bd)
+	}
+
+	return 0
+}
+
+func memoryEqual(a, b interface{}) bool {
+	// compare numbers and times
+	if (memoryNumber(a) && memoryNumber(b)) || (memoryIsTime(a) && memoryIsTime(b)) {
+		return memoryCompare(a, b) == 0
+	}
+
+	// compare documents
+	ad, aok := a.(bson.M)
+	bd, bok := b.(bson.M)
+	if aok && bok {
+		if len(ad) != len(bd) {
+			return false
+		}
+
+		for key, value := range ad {
+			other, ok := bd[key]
+			if !ok || !memoryEqual(value, other) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func memoryIsTime(value interface{}) bool {
+	_, ok := value.(time.Time)
+	return ok
+}
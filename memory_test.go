@@ -0,0 +1,732 @@
+package mgots
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBackendInsert(t *testing.T) {
+	mb := NewMemoryBackend()
+	tsc := WrapBackend(mb, OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 2; i++ {
+		err := tsc.Insert(now, map[string]float64{
+			"value": float64(i),
+		}, nil)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []bson.M{
+		{
+			"start":  parseTime("Jul 15 15:15:00"),
+			"series": SeriesID(nil),
+			"tags":   bson.M{},
+			"samples": bson.M{
+				"15": bson.M{
+					"start": parseTime("Jul 15 15:15:15"),
+					"value": bson.M{
+						"sum":   float64(1),
+						"num":   int(2),
+						"max":   float64(1),
+						"min":   float64(0),
+						"sumsq": float64(1),
+						"first": bson.D{{Name: "t", Value: parseTime("Jul 15 15:15:15")}, {Name: "v", Value: float64(0)}},
+						"last":  bson.D{{Name: "t", Value: parseTime("Jul 15 15:15:15")}, {Name: "v", Value: float64(1)}},
+					},
+				},
+			},
+			"sum": bson.M{
+				"value": float64(1),
+			},
+			"num": bson.M{
+				"value": int(2),
+			},
+			"max": bson.M{
+				"value": float64(1),
+			},
+			"min": bson.M{
+				"value": float64(0),
+			},
+			"sumsq": bson.M{
+				"value": float64(1),
+			},
+			"first": bson.M{
+				"value": bson.D{{Name: "t", Value: parseTime("Jul 15 15:15:15")}, {Name: "v", Value: float64(0)}},
+			},
+			"last": bson.M{
+				"value": bson.D{{Name: "t", Value: parseTime("Jul 15 15:15:15")}, {Name: "v", Value: float64(1)}},
+			},
+		},
+	}, mb.sets)
+}
+
+func TestMemoryBackendAggregateSamples(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	bulk := tsc.Bulk()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{
+			"value": float64(i),
+		}, bson.M{
+			"foo":  "bar",
+			"host": "one",
+		})
+	}
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{
+			"value": float64(10 + i),
+		}, bson.M{
+			"foo":  "bar",
+			"host": "two",
+		})
+	}
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Second), map[string]float64{
+			"value": float64(20 + i),
+		}, bson.M{
+			"foo":  "baz",
+			"host": "three",
+		})
+	}
+
+	err := bulk.Run()
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSamples(now.Add(time.Second), now.Add(3*time.Second), []string{"value"}, bson.M{
+		"foo": "bar",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &TimeSeries{
+		Samples: []Sample{
+			{
+				Start: parseTime("Jul 15 15:15:16"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 11, Min: 1, Num: 2, Sum: 12, SumSq: 122, Rate: 12,
+						First: Point{Time: parseTime("Jul 15 15:15:16"), Value: 1},
+						Last:  Point{Time: parseTime("Jul 15 15:15:16"), Value: 11},
+					},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:15:17"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 12, Min: 2, Num: 2, Sum: 14, SumSq: 148, Rate: 14,
+						First: Point{Time: parseTime("Jul 15 15:15:17"), Value: 2},
+						Last:  Point{Time: parseTime("Jul 15 15:15:17"), Value: 12},
+					},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:15:18"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 13, Min: 3, Num: 2, Sum: 16, SumSq: 178, Rate: 16,
+						First: Point{Time: parseTime("Jul 15 15:15:18"), Value: 3},
+						Last:  Point{Time: parseTime("Jul 15 15:15:18"), Value: 13},
+					},
+				},
+			},
+		},
+	}, ts)
+}
+
+func TestMemoryBackendAggregateSets(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	bulk := tsc.Bulk()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Minute), map[string]float64{
+			"value": float64(i),
+		}, bson.M{
+			"foo":  "bar",
+			"host": "one",
+		})
+	}
+
+	for i := 0; i < 5; i++ {
+		bulk.Insert(now.Add(time.Duration(i)*time.Minute), map[string]float64{
+			"value": float64(10 + i),
+		}, bson.M{
+			"foo":  "bar",
+			"host": "two",
+		})
+	}
+
+	err := bulk.Run()
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSets(now.Add(time.Minute), now.Add(3*time.Minute), []string{"value", "other"}, bson.M{
+		"foo": "bar",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &TimeSeries{
+		Samples: []Sample{
+			{
+				Start: parseTime("Jul 15 15:16:00"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 11, Min: 1, Num: 2, Sum: 12, SumSq: 122,
+						First: Point{Time: parseTime("Jul 15 15:16:15"), Value: 1},
+						Last:  Point{Time: parseTime("Jul 15 15:16:15"), Value: 11},
+					},
+					"other": {},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:17:00"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 12, Min: 2, Num: 2, Sum: 14, SumSq: 148,
+						First: Point{Time: parseTime("Jul 15 15:17:15"), Value: 2},
+						Last:  Point{Time: parseTime("Jul 15 15:17:15"), Value: 12},
+					},
+					"other": {},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:18:00"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 13, Min: 3, Num: 2, Sum: 16, SumSq: 178,
+						First: Point{Time: parseTime("Jul 15 15:18:15"), Value: 3},
+						Last:  Point{Time: parseTime("Jul 15 15:18:15"), Value: 13},
+					},
+					"other": {},
+				},
+			},
+		},
+	}, ts)
+}
+
+func TestMemoryBackendEnsureIndexes(t *testing.T) {
+	mb := NewMemoryBackend()
+	tsc := WrapBackend(mb, OneMinuteOf60Seconds)
+
+	assert.NoError(t, tsc.EnsureIndexes(time.Hour))
+
+	err := tsc.Insert(time.Now().Add(-2*time.Hour), map[string]float64{
+		"value": 1,
+	}, nil)
+	assert.NoError(t, err)
+
+	err = tsc.Insert(time.Now(), map[string]float64{
+		"value": 1,
+	}, nil)
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSets(time.Now().Add(-3*time.Hour), time.Now(), []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+}
+
+func TestMemoryBackendFirstLast(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i, value := range []float64{5, 7, 3} {
+		err := tsc.Insert(now.Add(time.Duration(2-i)*100*time.Millisecond), map[string]float64{
+			"value": value,
+		}, nil)
+		assert.NoError(t, err)
+	}
+
+	ts, err := tsc.AggregateSamples(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Point{Time: now, Value: 3}, ts.Samples[0].Metrics["value"].First)
+	assert.Equal(t, Point{Time: now.Add(200 * time.Millisecond), Value: 5}, ts.Samples[0].Metrics["value"].Last)
+
+	ts, err = tsc.AggregateSets(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Point{Time: now, Value: 3}, ts.First("value"))
+	assert.Equal(t, Point{Time: now.Add(200 * time.Millisecond), Value: 5}, ts.Last("value"))
+}
+
+func TestMemoryBackendSketches(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	tsc.EnableSketches("latency")
+
+	bulk := tsc.Bulk()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 1; i <= 1000; i++ {
+		bulk.Insert(now.Add(time.Duration(i%120)*time.Second), map[string]float64{
+			"latency": float64(i),
+			"other":   float64(i),
+		}, nil)
+	}
+
+	err := bulk.Run()
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSamples(now, now.Add(2*time.Minute), []string{"latency", "other"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 120)
+	assert.InEpsilon(t, 500, ts.Quantile("latency", 0.5), SketchAccuracy*2)
+	assert.InEpsilon(t, 990, ts.Quantile("latency", 0.99), SketchAccuracy*2)
+	assert.Equal(t, float64(1000), ts.Quantile("latency", 1))
+	assert.Equal(t, float64(0), ts.Quantile("other", 0.5))
+
+	ts, err = tsc.AggregateSets(now, now.Add(2*time.Minute), []string{"latency"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 3)
+	assert.InEpsilon(t, 500, ts.Quantile("latency", 0.5), SketchAccuracy*2)
+}
+
+func TestMemoryBackendInsertDistinct(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	bulk := tsc.Bulk()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 1000; i++ {
+		bulk.InsertDistinct(now.Add(time.Duration(i%10)*time.Second), map[string][]string{
+			"users": {"user-" + strconv.Itoa(i%200)},
+		}, nil)
+	}
+
+	err := bulk.Run()
+	assert.NoError(t, err)
+
+	err = tsc.InsertDistinct(now, map[string][]string{
+		"users": {"user-1000"},
+	}, nil)
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSamples(now, now.Add(time.Minute), []string{"users"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 10)
+	assert.InEpsilon(t, 21, ts.Samples[0].Metrics["users"].Cardinality(), 0.1)
+	assert.InEpsilon(t, 20, ts.Samples[1].Metrics["users"].Cardinality(), 0.1)
+	assert.InEpsilon(t, 201, ts.Cardinality("users"), 0.1)
+	assert.Equal(t, int64(0), ts.Num("users"))
+
+	ts, err = tsc.AggregateSets(now, now.Add(time.Minute), []string{"users"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+	assert.InEpsilon(t, 201, ts.Cardinality("users"), 0.1)
+}
+
+func TestMemoryBackendInsertCounter(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneHourOf60Minutes)
+
+	now := parseTime("Jul 15 15:15:00")
+
+	for i, value := range []float64{100, 160, 220, 20, 80} {
+		err := tsc.InsertCounter(now.Add(time.Duration(i)*30*time.Second), map[string]float64{
+			"requests": value,
+		}, bson.M{"server": "one"})
+		assert.NoError(t, err)
+	}
+
+	err := tsc.InsertCounter(now, map[string]float64{
+		"requests": 1000,
+	}, bson.M{"server": "one"})
+	assert.NoError(t, err)
+
+	err = tsc.InsertCounter(now, map[string]float64{
+		"requests": 1000,
+	}, bson.M{"server": "two"})
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSamples(now, now.Add(2*time.Minute), []string{"requests"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 3)
+	assert.Equal(t, float64(60), ts.Samples[0].Metrics["requests"].Sum)
+	assert.Equal(t, float64(1), ts.Samples[0].Metrics["requests"].Rate)
+	assert.Equal(t, float64(80), ts.Samples[1].Metrics["requests"].Sum)
+	assert.Equal(t, 80.0/60, ts.Samples[1].Metrics["requests"].Rate)
+	assert.Equal(t, float64(60), ts.Samples[2].Metrics["requests"].Sum)
+	assert.Equal(t, float64(200), ts.Sum("requests"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = tsc.InsertCounterContext(ctx, now.Add(3*time.Minute), map[string]float64{
+		"requests": 140,
+	}, bson.M{"server": "one"})
+	assert.Equal(t, context.Canceled, err)
+
+	err = tsc.InsertCounter(now.Add(4*time.Minute), map[string]float64{
+		"requests": 200,
+	}, bson.M{"server": "one"})
+	assert.NoError(t, err)
+
+	ts, err = tsc.AggregateSamples(now.Add(3*time.Minute), now.Add(4*time.Minute), []string{"requests"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+	assert.Equal(t, float64(120), ts.Sum("requests"))
+}
+
+func TestMemoryBackendInsertGauge(t *testing.T) {
+	mb := NewMemoryBackend()
+	tsc := WrapBackend(mb, OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 2; i++ {
+		err := tsc.InsertGauge(now, map[string]float64{
+			"value": 10,
+		}, nil)
+		assert.NoError(t, err)
+
+		err = tsc.InsertGauge(now.Add(time.Second), map[string]float64{
+			"value": 5,
+		}, nil)
+		assert.NoError(t, err)
+	}
+
+	bulk := tsc.Bulk()
+	bulk.InsertGauge(now.Add(500*time.Millisecond), map[string]float64{
+		"value": 30,
+	}, nil)
+	bulk.InsertGauge(now, map[string]float64{
+		"value": 20,
+	}, nil)
+	assert.NoError(t, bulk.Run())
+
+	assert.Equal(t, []bson.M{
+		{
+			"start":  parseTime("Jul 15 15:15:00"),
+			"series": SeriesID(nil),
+			"tags":   bson.M{},
+			"samples": bson.M{
+				"15": bson.M{
+					"start": parseTime("Jul 15 15:15:15"),
+					"value": bson.M{
+						"sum":   float64(30),
+						"num":   int(1),
+						"max":   float64(30),
+						"min":   float64(30),
+						"sumsq": float64(900),
+						"first": pointDoc(Point{Time: now.Add(500 * time.Millisecond), Value: 30}),
+						"last":  pointDoc(Point{Time: now.Add(500 * time.Millisecond), Value: 30}),
+					},
+				},
+				"16": bson.M{
+					"start": parseTime("Jul 15 15:15:16"),
+					"value": bson.M{
+						"sum":   float64(5),
+						"num":   int(1),
+						"max":   float64(5),
+						"min":   float64(5),
+						"sumsq": float64(25),
+						"first": pointDoc(Point{Time: now.Add(time.Second), Value: 5}),
+						"last":  pointDoc(Point{Time: now.Add(time.Second), Value: 5}),
+					},
+				},
+			},
+			"sum": bson.M{
+				"value": float64(35),
+			},
+			"num": bson.M{
+				"value": int(2),
+			},
+			"max": bson.M{
+				"value": float64(30),
+			},
+			"min": bson.M{
+				"value": float64(5),
+			},
+			"sumsq": bson.M{
+				"value": float64(925),
+			},
+			"first": bson.M{
+				"value": pointDoc(Point{Time: now.Add(500 * time.Millisecond), Value: 30}),
+			},
+			"last": bson.M{
+				"value": pointDoc(Point{Time: now.Add(time.Second), Value: 5}),
+			},
+		},
+	}, mb.sets)
+}
+
+func TestMemoryBackendDelete(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:14:00")
+
+	bulk := tsc.Bulk()
+	for i := 0; i < 18; i++ {
+		for _, host := range []string{"a", "b"} {
+			bulk.Insert(now.Add(time.Duration(i)*10*time.Second), map[string]float64{
+				"value": float64(i),
+			}, bson.M{"host": host})
+		}
+	}
+	assert.NoError(t, bulk.Run())
+
+	err := tsc.Delete(parseTime("Jul 15 15:14:30"), parseTime("Jul 15 15:16:20"), bson.M{"host": "a"})
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSets(now, now.Add(3*time.Minute), []string{"value"}, bson.M{"host": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Sample{
+		{
+			Start: parseTime("Jul 15 15:14:00"),
+			Metrics: map[string]Metric{
+				"value": {
+					Max: 2, Min: 0, Num: 3, Sum: 3, SumSq: 5,
+					First: Point{Time: parseTime("Jul 15 15:14:00"), Value: 0},
+					Last:  Point{Time: parseTime("Jul 15 15:14:20"), Value: 2},
+				},
+			},
+		},
+		{
+			Start: parseTime("Jul 15 15:16:00"),
+			Metrics: map[string]Metric{
+				"value": {
+					Max: 17, Min: 15, Num: 3, Sum: 48, SumSq: 770,
+					First: Point{Time: parseTime("Jul 15 15:16:30"), Value: 15},
+					Last:  Point{Time: parseTime("Jul 15 15:16:50"), Value: 17},
+				},
+			},
+		},
+	}, ts.Samples)
+
+	ts, err = tsc.AggregateSamples(now, now.Add(3*time.Minute), []string{"value"}, bson.M{"host": "a"})
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 6)
+
+	ts, err = tsc.AggregateSets(now, now.Add(3*time.Minute), []string{"value"}, bson.M{"host": "b"})
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 3)
+	assert.Equal(t, int64(18), ts.Num("value"))
+
+	err = tsc.Delete(parseTime("Jul 15 15:14:00"), parseTime("Jul 15 15:14:00"), bson.M{"host": "b"})
+	assert.NoError(t, err)
+
+	err = tsc.Delete(parseTime("Jul 15 15:16:10"), parseTime("Jul 15 15:16:20"), bson.M{"host": "b"})
+	assert.NoError(t, err)
+
+	ts, err = tsc.AggregateSets(now, now.Add(3*time.Minute), []string{"value"}, bson.M{"host": "b"})
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 3)
+	assert.Equal(t, int64(15), ts.Num("value"))
+	assert.Equal(t, float64(153-27), ts.Sum("value"))
+}
+
+func TestMemoryBackendAggregateAllMetrics(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	bulk := tsc.Bulk()
+	bulk.Insert(now, map[string]float64{"cpu": 1, "mem": 2}, bson.M{"host": "a"})
+	bulk.Insert(now.Add(time.Second), map[string]float64{"cpu": 3}, bson.M{"host": "b"})
+	bulk.Insert(now.Add(time.Hour), map[string]float64{"disk": 4}, bson.M{"host": "a"})
+	assert.NoError(t, bulk.Run())
+
+	ts, err := tsc.AggregateSets(now, now, []string{AllMetrics}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+	assert.Len(t, ts.Samples[0].Metrics, 2)
+	assert.Equal(t, float64(4), ts.Sum("cpu"))
+	assert.Equal(t, float64(2), ts.Sum("mem"))
+
+	ts, err = tsc.AggregateSamples(now, now.Add(time.Second), []string{AllMetrics}, bson.M{"host": "b"})
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+	assert.Len(t, ts.Samples[0].Metrics, 1)
+	assert.Equal(t, float64(3), ts.Sum("cpu"))
+}
+
+func TestMemoryBackendMatchers(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	bulk := tsc.Bulk()
+	bulk.Insert(now, map[string]float64{"value": 1}, bson.M{"server": "web-1", "env": "prod", "region": "eu"})
+	bulk.Insert(now, map[string]float64{"value": 2}, bson.M{"server": "web-2", "env": "staging", "region": "us"})
+	bulk.Insert(now, map[string]float64{"value": 4}, bson.M{"server": "db-1", "env": "prod"})
+	assert.NoError(t, bulk.Run())
+
+	for _, item := range []struct {
+		tags bson.M
+		sum  float64
+	}{
+		{tags: bson.M{"server": Regex("^web-")}, sum: 3},
+		{tags: bson.M{"server": Regex("^web-"), "env": NotEqual("staging")}, sum: 1},
+		{tags: bson.M{"region": NotEqual("eu")}, sum: 6},
+		{tags: bson.M{"server": In("web-2", "db-1")}, sum: 6},
+		{tags: bson.M{"region": Exists()}, sum: 3},
+		{tags: bson.M{"region": Missing()}, sum: 4},
+		{tags: bson.M{Or: []bson.M{{"region": "us"}, {"server": "db-1"}}}, sum: 6},
+	} {
+		ts, err := tsc.AggregateSets(now, now, []string{"value"}, item.tags)
+		assert.NoError(t, err)
+		assert.Equal(t, item.sum, ts.Sum("value"), "%v", item.tags)
+	}
+}
+
+func TestMemoryBackendSeriesID(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	tags1 := bson.M{"host": "a", "region": "eu"}
+	tags2 := bson.M{"region": "eu", "host": "a"}
+	assert.Equal(t, SeriesID(tags1), SeriesID(tags2))
+	assert.NotEqual(t, SeriesID(tags1), SeriesID(bson.M{"host": "a"}))
+	assert.Len(t, SeriesID(nil), 32)
+
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	assert.NoError(t, err)
+	assert.Equal(t, SeriesID(bson.M{"since": now}), SeriesID(bson.M{"since": now.In(zurich)}))
+	assert.Equal(t, SeriesID(bson.M{"meta": bson.M{"a": 1, "b": 2}}), SeriesID(bson.M{"meta": map[string]interface{}{"b": 2, "a": 1}}))
+	assert.NotEqual(t, SeriesID(bson.M{"meta": bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}}}), SeriesID(bson.M{"meta": bson.D{{Name: "b", Value: 2}, {Name: "a", Value: 1}}}))
+
+	bulk := tsc.Bulk()
+	bulk.Insert(now, map[string]float64{"value": 1}, tags1)
+	bulk.Insert(now, map[string]float64{"value": 2}, tags2)
+	bulk.Insert(now, map[string]float64{"value": 4}, bson.M{"host": "a"})
+	assert.NoError(t, bulk.Run())
+
+	assert.NoError(t, tsc.Insert(now, map[string]float64{"value": 8}, tags2))
+
+	ts, err := tsc.AggregateSets(now, now, []string{"value"}, bson.M{"host": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(15), ts.Sum("value"))
+
+	ts, err = tsc.AggregateSets(now, now, []string{"value"}, Exact(tags1))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(11), ts.Sum("value"))
+
+	ts, err = tsc.AggregateSets(now, now, []string{"value"}, Exact(bson.M{"host": "a"}))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(4), ts.Sum("value"))
+
+	series, err := tsc.Series(now, now, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []bson.M{tags1, {"host": "a"}}, series)
+}
+
+func TestMemoryBackendAggregateBy(t *testing.T) {
+	testAggregateBy(t, WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds))
+}
+
+func TestMemoryBackendAggregateSamplesStep(t *testing.T) {
+	testAggregateSamplesStep(t, WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds))
+}
+
+func TestMemoryBackendAggregateSamplesStepIn(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Zurich")
+	assert.NoError(t, err)
+
+	testAggregateSamplesStepIn(t, WrapBackend(NewMemoryBackend(), InLocation(OneDayOf24Hours, loc)), loc)
+}
+
+func TestMemoryBackendContext(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	now := parseTime("Jul 15 15:14:00")
+
+	ctx := context.Background()
+	assert.NoError(t, tsc.InsertContext(ctx, now, map[string]float64{"value": 1}, nil))
+	assert.NoError(t, tsc.EnsureIndexesContext(ctx, 0))
+
+	ts, err := tsc.AggregateSamplesContext(ctx, now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), ts.Sum("value"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = tsc.InsertContext(ctx, now, map[string]float64{"value": 1}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.AggregateSetsContext(ctx, now, now, []string{"value"}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	assert.Equal(t, context.Canceled, tsc.InsertDistinctContext(ctx, now, map[string][]string{"users": {"a"}}, nil))
+	assert.Equal(t, context.Canceled, tsc.InsertGaugeContext(ctx, now, map[string]float64{"gauge": 1}, nil))
+	assert.Equal(t, context.Canceled, tsc.DeleteContext(ctx, now, now, nil))
+
+	_, err = tsc.AggregateSamplesStepContext(ctx, now, now, time.Minute, []string{"value"}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.AggregateSamplesStepInContext(ctx, now, now, time.Minute, time.UTC, []string{"value"}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.AggregateSamplesByContext(ctx, now, now, []string{"value"}, nil, []string{"host"})
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.AggregateSetsByContext(ctx, now, now, []string{"value"}, nil, []string{"host"})
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.StreamSamplesContext(ctx, now, now, []string{"value"}, nil, StreamOptions{})
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.StreamSetsContext(ctx, now, now, []string{"value"}, nil, StreamOptions{})
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.MetricsContext(ctx, time.Time{}, time.Time{}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.SeriesContext(ctx, time.Time{}, time.Time{}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.TagKeysContext(ctx, time.Time{}, time.Time{}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.TagValuesContext(ctx, "host", time.Time{}, time.Time{}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.LatestContext(ctx, []string{"value"}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.LastNContext(ctx, 2, []string{"value"}, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.SweepContext(ctx, now, []RetentionPolicy{{Retention: time.Hour}})
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = tsc.MigrateSeriesContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	rollup := &Rollup{
+		Name:    "rollup",
+		Source:  tsc,
+		Target:  WrapBackend(NewMemoryBackend(), OneHourOf60Minutes),
+		Metrics: []string{"value"},
+		Store:   NewMemoryCheckpointStore(),
+		Start:   now,
+	}
+	assert.Equal(t, context.Canceled, rollup.RunContext(ctx, now.Add(time.Hour)))
+
+	checkpoint, err := rollup.Store.Load("rollup")
+	assert.NoError(t, err)
+	assert.True(t, checkpoint.IsZero())
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err = tsc.AggregateSamplesContext(ctx, now, now, []string{"value"}, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.Equal(t, context.DeadlineExceeded, tsc.EnsureIndexesContext(ctx, 0))
+
+	ts, err = tsc.AggregateSamples(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), ts.Sum("value"))
+}
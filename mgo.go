@@ -0,0 +1,419 @@
+package mgots
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type mgoBackend struct {
+	coll *mgo.Collection
+}
+
+func (b *mgoBackend) Upsert(ctx context.Context, upserts []Upsert) error {
+	// skip if there is nothing to do
+	if len(upserts) == 0 {
+		return nil
+	}
+
+	// get collection
+	coll, done, err := b.collection(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// use a simple upsert for a single operation
+	if len(upserts) == 1 {
+		_, err := coll.Upsert(upserts[0].Query, upserts[0].update())
+		return mgoError(ctx, err)
+	}
+
+	// prepare bulk operation
+	bulk := coll.Bulk()
+	bulk.Unordered()
+
+	// queue upserts
+	for _, upsert := range upserts {
+		bulk.Upsert(upsert.Query, upsert.update())
+	}
+
+	_, err = bulk.Run()
+	return mgoError(ctx, err)
+}
+
+func (b *mgoBackend) AggregateSamples(ctx context.Context, query Query) ([]Sample, error) {
+	// prepare pipe
+	pipe, err := b.pipe(ctx, samplesPipeline(query), query)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetch result
+	var samples []pipelineSample
+	err = pipe.All(&samples)
+	if err != nil {
+		return nil, mgoError(ctx, err)
+	}
+
+	return pipelineSamples(samples), nil
+}
+
+func (b *mgoBackend) AggregateSets(ctx context.Context, query Query) ([]Sample, error) {
+	// prepare pipe
+	pipe, err := b.pipe(ctx, setsPipeline(query), query)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetch result
+	var samples []pipelineSample
+	err = pipe.All(&samples)
+	if err != nil {
+		return nil, mgoError(ctx, err)
+	}
+
+	return pipelineSamples(samples), nil
+}
+
+func (b *mgoBackend) IterateSamples(ctx context.Context, query Query) (Iterator, error) {
+	// prepare pipe
+	pipe, err := b.pipe(ctx, samplesPipeline(query), query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mgoIterator{ctx: ctx, iter: pipe.Iter()}, nil
+}
+
+func (b *mgoBackend) IterateSets(ctx context.Context, query Query) (Iterator, error) {
+	// prepare pipe
+	pipe, err := b.pipe(ctx, setsPipeline(query), query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mgoIterator{ctx: ctx, iter: pipe.Iter()}, nil
+}
+
+func (b *mgoBackend) pipe(ctx context.Context, pipeline []bson.M, query Query) (*mgo.Pipe, error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// prepare pipe
+	pipe := b.coll.Pipe(pipeline)
+
+	// set options
+	if query.AllowDiskUse {
+		pipe = pipe.AllowDiskUse()
+	}
+	if query.BatchSize > 0 {
+		pipe = pipe.Batch(query.BatchSize)
+	}
+
+	// set max time
+	if timeout, ok := contextTimeout(ctx); ok {
+		pipe = pipe.SetMaxTime(timeout)
+	}
+
+	return pipe, nil
+}
+
+func (b *mgoBackend) collection(ctx context.Context) (*mgo.Collection, func(), error) {
+	// check context
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+
+	// use collection directly if there is no deadline
+	timeout, ok := contextTimeout(ctx)
+	if !ok {
+		return b.coll, func() {}, nil
+	}
+
+	// copy session and set socket timeout
+	sess := b.coll.Database.Session.Copy()
+	sess.SetSocketTimeout(timeout)
+
+	return b.coll.With(sess), sess.Close, nil
+}
+
+func (b *mgoBackend) Starts(ctx context.Context, query Query, limit int) ([]time.Time, error) {
+	// prepare pipe
+	pipe, err := b.pipe(ctx, startsPipeline(query, limit), query)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetch result
+	var starts []pipelineStart
+	err = pipe.All(&starts)
+	if err != nil {
+		return nil, mgoError(ctx, err)
+	}
+
+	return pipelineStarts(starts), nil
+}
+
+func (b *mgoBackend) Metrics(ctx context.Context, query Query) ([]string, error) {
+	// prepare pipe
+	pipe, err := b.pipe(ctx, metricsPipeline(query), query)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetch result
+	var names []pipelineName
+	err = pipe.All(&names)
+	if err != nil {
+		return nil, mgoError(ctx, err)
+	}
+
+	return pipelineNames(names), nil
+}
+
+func (b *mgoBackend) Series(ctx context.Context, query Query) ([]bson.M, error) {
+	// prepare pipe
+	pipe, err := b.pipe(ctx, seriesPipeline(query), query)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetch result
+	var series []pipelineSeries
+	err = pipe.All(&series)
+	if err != nil {
+		return nil, mgoError(ctx, err)
+	}
+
+	return pipelineSeriesTags(series), nil
+}
+
+func (b *mgoBackend) TagKeys(ctx context.Context, query Query) ([]string, error) {
+	// prepare pipe
+	pipe, err := b.pipe(ctx, tagKeysPipeline(query), query)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetch result
+	var keys []pipelineName
+	err = pipe.All(&keys)
+	if err != nil {
+		return nil, mgoError(ctx, err)
+	}
+
+	return pipelineNames(keys), nil
+}
+
+func (b *mgoBackend) TagValues(ctx context.Context, query Query, key string) ([]interface{}, error) {
+	// get collection
+	coll, done, err := b.collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// get distinct values
+	var values []interface{}
+	err = coll.Find(matchSets(query)).Distinct("tags."+key, &values)
+	if err != nil {
+		return nil, mgoError(ctx, err)
+	}
+
+	return values, nil
+}
+
+func (b *mgoBackend) Update(ctx context.Context, query Query, pipeline []bson.M) error {
+	// get collection
+	coll, done, err := b.collection(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// update sets
+	_, err = coll.UpdateAll(matchSets(query), pipeline)
+
+	return mgoError(ctx, err)
+}
+
+func (b *mgoBackend) Remove(ctx context.Context, query Query) (int, error) {
+	// get collection
+	coll, done, err := b.collection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	// remove sets
+	info, err := coll.RemoveAll(matchSets(query))
+	if err != nil {
+		return 0, mgoError(ctx, err)
+	}
+
+	return info.Removed, nil
+}
+
+func (b *mgoBackend) MigrateSeries(ctx context.Context, id func(tags bson.M) string) (int, error) {
+	// get collection
+	coll, done, err := b.collection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	// iterate sets without series
+	iter := coll.Find(bson.M{"series": bson.M{"$exists": false}}).Select(bson.M{"tags": 1}).Iter()
+
+	// prepare bulk
+	bulk := coll.Bulk()
+	bulk.Unordered()
+	var queued, updated int
+
+	// queue updates
+	var set struct {
+		ID   interface{} `bson:"_id"`
+		Tags bson.M      `bson:"tags"`
+	}
+	for iter.Next(&set) {
+		// check context
+		if ctx.Err() != nil {
+			_ = iter.Close()
+			return updated, ctx.Err()
+		}
+
+		// queue update
+		bulk.Update(bson.M{"_id": set.ID}, bson.M{"$set": bson.M{"series": id(set.Tags)}})
+		queued++
+
+		// run full bulk
+		if queued == 1000 {
+			_, err = bulk.Run()
+			if err != nil {
+				_ = iter.Close()
+				return updated, mgoError(ctx, err)
+			}
+
+			updated += queued
+			queued = 0
+			bulk = coll.Bulk()
+			bulk.Unordered()
+		}
+	}
+
+	// check error
+	err = iter.Close()
+	if err != nil {
+		return updated, mgoError(ctx, err)
+	}
+
+	// run remaining bulk
+	if queued > 0 {
+		_, err = bulk.Run()
+		if err != nil {
+			return updated, mgoError(ctx, err)
+		}
+
+		updated += queued
+	}
+
+	return updated, nil
+}
+
+func (b *mgoBackend) EnsureIndexes(ctx context.Context, removeAfter time.Duration) error {
+	// get collection
+	coll, done, err := b.collection(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// ensure start index
+	err = coll.EnsureIndex(mgo.Index{
+		Key:         []string{"start"},
+		ExpireAfter: removeAfter,
+		Background:  true,
+	})
+	if err != nil {
+		return mgoError(ctx, err)
+	}
+
+	// ensure tags index
+	err = coll.EnsureIndex(mgo.Index{
+		Key:        []string{"tags"},
+		Background: true,
+	})
+	if err != nil {
+		return mgoError(ctx, err)
+	}
+
+	// ensure start series index
+	err = coll.EnsureIndex(mgo.Index{
+		Key:        []string{"start", "series"},
+		Background: true,
+	})
+	if err != nil {
+		return mgoError(ctx, err)
+	}
+
+	return nil
+}
+
+type mgoIterator struct {
+	ctx  context.Context
+	iter *mgo.Iter
+	err  error
+}
+
+func (i *mgoIterator) Next(sample *Sample) bool {
+	// check context
+	if i.ctx.Err() != nil {
+		i.err = i.ctx.Err()
+		return false
+	}
+
+	// decode sample
+	var ps pipelineSample
+	if !i.iter.Next(&ps) {
+		return false
+	}
+
+	// convert sample
+	*sample = ps.sample()
+
+	return true
+}
+
+func (i *mgoIterator) Err() error {
+	// check context error
+	if i.err != nil {
+		return i.err
+	}
+
+	return mgoError(i.ctx, i.iter.Err())
+}
+
+func (i *mgoIterator) Close() error {
+	return mgoError(i.ctx, i.iter.Close())
+}
+
+func mgoError(ctx context.Context, err error) error {
+	// check max time and socket timeouts
+	var timeout bool
+	switch err := err.(type) {
+	case *mgo.QueryError:
+		timeout = err.Code == 50
+	case *mgo.LastError:
+		timeout = err.Code == 50
+	case net.Error:
+		timeout = err.Timeout()
+	}
+
+	return contextError(ctx, err, timeout)
+}
@@ -0,0 +1,335 @@
+package mgots
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// A Level is a single resolution of a MultiCollection.
+type Level struct {
+	// The collection that stores the level.
+	Collection *Collection
+
+	// The duration for which sets are retained. Zero means forever.
+	Retention time.Duration
+}
+
+// A MultiBulk represents a bulk operation that writes to all levels of a
+// MultiCollection at once.
+type MultiBulk struct {
+	bulks []*Bulk
+}
+
+// Insert will queue the insert in the bulk operation of all levels.
+func (b *MultiBulk) Insert(timestamp time.Time, metrics map[string]float64, tags bson.M) {
+	for _, bulk := range b.bulks {
+		bulk.Insert(timestamp, metrics, tags)
+	}
+}
+
+// InsertDistinct will queue the insert of the specified distinct values in the
+// bulk operation of all levels.
+func (b *MultiBulk) InsertDistinct(timestamp time.Time, values map[string][]string, tags bson.M) {
+	for _, bulk := range b.bulks {
+		bulk.InsertDistinct(timestamp, values, tags)
+	}
+}
+
+// InsertCounter will queue the insert of the increases of the specified
+// monotonic counters in the bulk operation of all levels.
+func (b *MultiBulk) InsertCounter(timestamp time.Time, counters map[string]float64, tags bson.M) {
+	for _, bulk := range b.bulks {
+		bulk.InsertCounter(timestamp, counters, tags)
+	}
+}
+
+// InsertGauge will queue the insert of the specified gauges in the bulk
+// operation of all levels.
+func (b *MultiBulk) InsertGauge(timestamp time.Time, gauges map[string]float64, tags bson.M) {
+	for _, bulk := range b.bulks {
+		bulk.InsertGauge(timestamp, gauges, tags)
+	}
+}
+
+// Run will run the bulk operations of all levels. All levels are written even
+// if one of them fails. The first error is returned.
+func (b *MultiBulk) Run() error {
+	return b.RunContext(context.Background())
+}
+
+// RunContext will run the bulk operations of all levels like Run but use the
+// specified context like Bulk.RunContext.
+func (b *MultiBulk) RunContext(ctx context.Context) error {
+	var firstErr error
+
+	for _, bulk := range b.bulks {
+		err := bulk.RunContext(ctx)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// A MultiCollection stores the same metrics in multiple collections with
+// different resolutions and retentions. Inserts are written to all levels
+// while queries are routed to the finest level that still covers the
+// requested range.
+type MultiCollection struct {
+	levels []Level
+}
+
+// WrapMulti will return a MultiCollection for the specified levels. The levels
+// must be ordered from the finest to the coarsest resolution.
+func WrapMulti(levels ...Level) *MultiCollection {
+	// check levels
+	if len(levels) == 0 {
+		panic("mgots: missing levels")
+	}
+
+	return &MultiCollection{
+		levels: levels,
+	}
+}
+
+// Insert will immediately write the specified metrics to all levels.
+func (c *MultiCollection) Insert(timestamp time.Time, metrics map[string]float64, tags bson.M) error {
+	return c.InsertContext(context.Background(), timestamp, metrics, tags)
+}
+
+// InsertContext will immediately write the specified metrics to all levels
+// like Insert but use the specified context like Bulk.RunContext.
+func (c *MultiCollection) InsertContext(ctx context.Context, timestamp time.Time, metrics map[string]float64, tags bson.M) error {
+	// prepare bulk
+	bulk := c.Bulk()
+	bulk.Insert(timestamp, metrics, tags)
+
+	return bulk.RunContext(ctx)
+}
+
+// InsertDistinct will immediately write the specified distinct values to all
+// levels.
+func (c *MultiCollection) InsertDistinct(timestamp time.Time, values map[string][]string, tags bson.M) error {
+	return c.InsertDistinctContext(context.Background(), timestamp, values, tags)
+}
+
+// InsertDistinctContext will immediately write the specified distinct values
+// to all levels like InsertDistinct but use the specified context like
+// Bulk.RunContext.
+func (c *MultiCollection) InsertDistinctContext(ctx context.Context, timestamp time.Time, values map[string][]string, tags bson.M) error {
+	// prepare bulk
+	bulk := c.Bulk()
+	bulk.InsertDistinct(timestamp, values, tags)
+
+	return bulk.RunContext(ctx)
+}
+
+// InsertCounter will immediately write the increases of the specified
+// monotonic counters to all levels.
+func (c *MultiCollection) InsertCounter(timestamp time.Time, counters map[string]float64, tags bson.M) error {
+	return c.InsertCounterContext(context.Background(), timestamp, counters, tags)
+}
+
+// InsertCounterContext will immediately write the increases of the specified
+// counters to all levels like InsertCounter but use the specified context like
+// Bulk.RunContext.
+func (c *MultiCollection) InsertCounterContext(ctx context.Context, timestamp time.Time, counters map[string]float64, tags bson.M) error {
+	// prepare bulk
+	bulk := c.Bulk()
+	bulk.InsertCounter(timestamp, counters, tags)
+
+	return bulk.RunContext(ctx)
+}
+
+// InsertGauge will immediately write the specified gauges to all levels.
+func (c *MultiCollection) InsertGauge(timestamp time.Time, gauges map[string]float64, tags bson.M) error {
+	return c.InsertGaugeContext(context.Background(), timestamp, gauges, tags)
+}
+
+// InsertGaugeContext will immediately write the specified gauges to all levels
+// like InsertGauge but use the specified context like Bulk.RunContext.
+func (c *MultiCollection) InsertGaugeContext(ctx context.Context, timestamp time.Time, gauges map[string]float64, tags bson.M) error {
+	// prepare bulk
+	bulk := c.Bulk()
+	bulk.InsertGauge(timestamp, gauges, tags)
+
+	return bulk.RunContext(ctx)
+}
+
+// Bulk will return a new bulk operation.
+func (c *MultiCollection) Bulk() *MultiBulk {
+	// prepare bulks
+	bulks := make([]*Bulk, 0, len(c.levels))
+	for _, level := range c.levels {
+		bulks = append(bulks, level.Collection.Bulk())
+	}
+
+	return &MultiBulk{bulks: bulks}
+}
+
+// Select will return the collection of the finest level that still retains
+// sets starting at the specified time. If no level covers the time, the
+// coarsest level is returned.
+func (c *MultiCollection) Select(first time.Time) *Collection {
+	// get now
+	now := time.Now()
+
+	// find finest covering level
+	for _, level := range c.levels {
+		if level.Retention == 0 || !level.Collection.res.SetTimestamp(first).Before(now.Add(-level.Retention)) {
+			return level.Collection
+		}
+	}
+
+	return c.levels[len(c.levels)-1].Collection
+}
+
+// AggregateSamples will aggregate all samples matching the specified time range
+// and tags using the finest level that covers the range.
+func (c *MultiCollection) AggregateSamples(first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.Select(first).AggregateSamples(first, last, metrics, tags)
+}
+
+// AggregateSamplesContext will aggregate all samples like AggregateSamples but
+// use the specified context like Collection.AggregateSamplesContext.
+func (c *MultiCollection) AggregateSamplesContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.Select(first).AggregateSamplesContext(ctx, first, last, metrics, tags)
+}
+
+// AggregateSamplesStep will aggregate all samples matching the specified time
+// range and tags into buckets of the specified step using the finest level that
+// covers the range.
+func (c *MultiCollection) AggregateSamplesStep(first, last time.Time, step time.Duration, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.AggregateSamplesStepContext(context.Background(), first, last, step, metrics, tags)
+}
+
+// AggregateSamplesStepContext will aggregate all samples like
+// AggregateSamplesStep but use the specified context like
+// Collection.AggregateSamplesContext.
+func (c *MultiCollection) AggregateSamplesStepContext(ctx context.Context, first, last time.Time, step time.Duration, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.Select(first).AggregateSamplesStepContext(ctx, first, last, step, metrics, tags)
+}
+
+// AggregateSamplesStepIn will aggregate all samples matching the specified time
+// range and tags into buckets of the specified step aligned in the specified
+// location using the finest level that covers the range.
+func (c *MultiCollection) AggregateSamplesStepIn(first, last time.Time, step time.Duration, loc *time.Location, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.AggregateSamplesStepInContext(context.Background(), first, last, step, loc, metrics, tags)
+}
+
+// AggregateSamplesStepInContext will aggregate all samples like
+// AggregateSamplesStepIn but use the specified context like
+// Collection.AggregateSamplesContext.
+func (c *MultiCollection) AggregateSamplesStepInContext(ctx context.Context, first, last time.Time, step time.Duration, loc *time.Location, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.Select(first).AggregateSamplesStepInContext(ctx, first, last, step, loc, metrics, tags)
+}
+
+// AggregateSets will aggregate only set level metrics matching the specified
+// time range and tags using the finest level that covers the range.
+func (c *MultiCollection) AggregateSets(first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.Select(first).AggregateSets(first, last, metrics, tags)
+}
+
+// AggregateSetsContext will aggregate only set level metrics like
+// AggregateSets but use the specified context like
+// Collection.AggregateSamplesContext.
+func (c *MultiCollection) AggregateSetsContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.Select(first).AggregateSetsContext(ctx, first, last, metrics, tags)
+}
+
+// AggregateSamplesBy will aggregate all samples grouped by the specified tag
+// keys using the finest level that covers the range.
+func (c *MultiCollection) AggregateSamplesBy(first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Group, error) {
+	return c.AggregateSamplesByContext(context.Background(), first, last, metrics, tags, groupBy)
+}
+
+// AggregateSamplesByContext will aggregate all samples like AggregateSamplesBy
+// but use the specified context like Collection.AggregateSamplesContext.
+func (c *MultiCollection) AggregateSamplesByContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Group, error) {
+	return c.Select(first).AggregateSamplesByContext(ctx, first, last, metrics, tags, groupBy)
+}
+
+// AggregateSetsBy will aggregate only set level metrics grouped by the
+// specified tag keys using the finest level that covers the range.
+func (c *MultiCollection) AggregateSetsBy(first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Group, error) {
+	return c.AggregateSetsByContext(context.Background(), first, last, metrics, tags, groupBy)
+}
+
+// AggregateSetsByContext will aggregate only set level metrics like
+// AggregateSetsBy but use the specified context like
+// Collection.AggregateSamplesContext.
+func (c *MultiCollection) AggregateSetsByContext(ctx context.Context, first, last time.Time, metrics []string, tags bson.M, groupBy []string) ([]Group, error) {
+	return c.Select(first).AggregateSetsByContext(ctx, first, last, metrics, tags, groupBy)
+}
+
+// Latest will return the most recent sample that contains at least one of the
+// specified metrics using the finest level.
+func (c *MultiCollection) Latest(metrics []string, tags bson.M) (*Sample, error) {
+	return c.LatestContext(context.Background(), metrics, tags)
+}
+
+// LatestContext will return the most recent sample like Latest but use the
+// specified context like Collection.AggregateSamplesContext.
+func (c *MultiCollection) LatestContext(ctx context.Context, metrics []string, tags bson.M) (*Sample, error) {
+	return c.levels[0].Collection.LatestContext(ctx, metrics, tags)
+}
+
+// LastN will return the n most recent samples that contain at least one of the
+// specified metrics using the finest level.
+func (c *MultiCollection) LastN(n int, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.LastNContext(context.Background(), n, metrics, tags)
+}
+
+// LastNContext will return the n most recent samples like LastN but use the
+// specified context like Collection.AggregateSamplesContext.
+func (c *MultiCollection) LastNContext(ctx context.Context, n int, metrics []string, tags bson.M) (*TimeSeries, error) {
+	return c.levels[0].Collection.LastNContext(ctx, n, metrics, tags)
+}
+
+// MigrateSeries will set the missing series identifiers of all levels like
+// Collection.MigrateSeries and return the total number of updated sets.
+func (c *MultiCollection) MigrateSeries() (int, error) {
+	return c.MigrateSeriesContext(context.Background())
+}
+
+// MigrateSeriesContext will set the missing series identifiers of all levels
+// like MigrateSeries but use the specified context like
+// Collection.MigrateSeriesContext.
+func (c *MultiCollection) MigrateSeriesContext(ctx context.Context) (int, error) {
+	// migrate levels
+	var updated int
+	for _, level := range c.levels {
+		n, err := level.Collection.MigrateSeriesContext(ctx)
+		updated += n
+		if err != nil {
+			return updated, err
+		}
+	}
+
+	return updated, nil
+}
+
+// EnsureIndexes will ensure that the necessary indexes have been created for
+// all levels. Sets are automatically removed when they fall behind the
+// retention of their level.
+func (c *MultiCollection) EnsureIndexes() error {
+	return c.EnsureIndexesContext(context.Background())
+}
+
+// EnsureIndexesContext will ensure the necessary indexes of all levels like
+// EnsureIndexes but use the specified context like
+// Collection.EnsureIndexesContext.
+func (c *MultiCollection) EnsureIndexesContext(ctx context.Context) error {
+	// ensure indexes
+	for _, level := range c.levels {
+		err := level.Collection.EnsureIndexesContext(ctx, level.Retention)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package mgots
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiCollection(t *testing.T) {
+	fine := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	coarse := WrapBackend(NewMemoryBackend(), OneDayOf24Hours)
+
+	mc := WrapMulti(Level{
+		Collection: fine,
+		Retention:  24 * time.Hour,
+	}, Level{
+		Collection: coarse,
+	})
+
+	recent := time.Now().Truncate(time.Minute)
+	old := recent.Add(-48 * time.Hour)
+
+	bulk := mc.Bulk()
+	for i := 0; i < 3; i++ {
+		bulk.Insert(recent.Add(time.Duration(i)*time.Second), map[string]float64{
+			"value": float64(i),
+		}, nil)
+		bulk.Insert(old.Add(time.Duration(i)*time.Second), map[string]float64{
+			"value": float64(i),
+		}, nil)
+	}
+	assert.NoError(t, bulk.Run())
+
+	assert.Equal(t, fine, mc.Select(recent))
+	assert.Equal(t, coarse, mc.Select(old))
+
+	ts, err := mc.AggregateSamples(recent, recent.Add(2*time.Second), []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 3)
+	assert.Equal(t, float64(3), ts.Sum("value"))
+
+	ts, err = mc.AggregateSamples(old, old.Add(2*time.Second), []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+	assert.Equal(t, float64(3), ts.Sum("value"))
+	assert.Equal(t, int64(3), ts.Num("value"))
+
+	ts, err = fine.AggregateSets(old, old, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(3), ts.Sum("value"))
+
+	assert.NoError(t, mc.EnsureIndexes())
+
+	ts, err = fine.AggregateSets(old, old, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 0)
+}
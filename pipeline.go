@@ -0,0 +1,609 @@
+package mgots
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// A pipelineMetric is a metric decoded from an aggregation pipeline. The
+// pipelines only collect the sketches and hyperloglogs which are merged once
+// decoded.
+type pipelineMetric struct {
+	Metric   `bson:",inline"`
+	Sketches []Sketch
+	HLLs     []HyperLogLog
+}
+
+type pipelineSample struct {
+	Start   time.Time
+	Tags    bson.M
+	Metrics map[string]pipelineMetric
+}
+
+func (ps pipelineSample) sample() Sample {
+	// prepare sample
+	sample := Sample{
+		Start:   ps.Start,
+		Tags:    ps.Tags,
+		Metrics: make(map[string]Metric, len(ps.Metrics)),
+	}
+
+	// merge sketches and hyperloglogs
+	for name, pm := range ps.Metrics {
+		metric := pm.Metric
+		for _, sketch := range pm.Sketches {
+			metric.Sketch = metric.Sketch.merge(sketch)
+		}
+		for _, hll := range pm.HLLs {
+			metric.HLL = metric.HLL.merge(hll)
+		}
+
+		sample.Metrics[name] = metric
+	}
+
+	return sample
+}
+
+func pipelineSamples(list []pipelineSample) []Sample {
+	// prepare samples
+	samples := make([]Sample, 0, len(list))
+
+	// convert samples
+	for _, ps := range list {
+		samples = append(samples, ps.sample())
+	}
+
+	return samples
+}
+
+func samplesPipeline(query Query) []bson.M {
+	// prepare aggregation pipeline
+	pipeline := []bson.M{
+		// get all matching sets
+		{
+			"$match": matchSets(query),
+		},
+		// turn samples into an array
+		{
+			"$addFields": bson.M{
+				"samples": bson.M{"$objectToArray": "$samples"},
+			},
+		},
+		// create a document for each sample
+		{
+			"$unwind": "$samples",
+		},
+		// make the sample the main document
+		{
+			"$replaceRoot": bson.M{"newRoot": "$samples.v"},
+		},
+		// match the exact time range
+		{
+			"$match": bson.M{
+				"start": bson.M{
+					"$gte": query.FirstSample,
+					"$lte": query.LastSample,
+				},
+			},
+		},
+		// group samples
+		{
+			"$group": bson.M{
+				"_id": "$start",
+				// more fields added below
+			},
+		},
+		// finalize layout
+		{
+			"$project": bson.M{
+				"_id":     false,
+				"start":   "$_id",
+				"metrics": bson.M{
+					// fields added below
+				},
+			},
+		},
+		// sort samples
+		{
+			"$sort": bson.M{"start": 1},
+		},
+	}
+
+	// group by buckets
+	if query.Step > 0 {
+		pipeline[5]["$group"].(bson.M)["_id"] = bucketStart(query.Step, query.Location)
+	}
+
+	// group by tags
+	if len(query.GroupBy) > 0 {
+		pipeline[3]["$replaceRoot"] = bson.M{
+			"newRoot": bson.M{
+				"$mergeObjects": []interface{}{"$samples.v", bson.M{"_tags": groupTags(query.GroupBy)}},
+			},
+		}
+		pipeline[5]["$group"].(bson.M)["_id"] = bson.M{"start": pipeline[5]["$group"].(bson.M)["_id"], "tags": "$_tags"}
+		pipeline[6]["$project"].(bson.M)["start"] = "$_id.start"
+		pipeline[6]["$project"].(bson.M)["tags"] = "$_id.tags"
+	}
+
+	// update pipeline
+	for _, name := range query.Metrics {
+		// add group fields
+		pipeline[5]["$group"].(bson.M)["max_"+name] = bson.M{"$max": "$" + name + ".max"}
+		pipeline[5]["$group"].(bson.M)["min_"+name] = bson.M{"$min": "$" + name + ".min"}
+		pipeline[5]["$group"].(bson.M)["num_"+name] = bson.M{"$sum": "$" + name + ".num"}
+		pipeline[5]["$group"].(bson.M)["sum_"+name] = bson.M{"$sum": "$" + name + ".sum"}
+		pipeline[5]["$group"].(bson.M)["sumsq_"+name] = bson.M{"$sum": "$" + name + ".sumsq"}
+		pipeline[5]["$group"].(bson.M)["first_"+name] = bson.M{"$min": "$" + name + ".first"}
+		pipeline[5]["$group"].(bson.M)["last_"+name] = bson.M{"$max": "$" + name + ".last"}
+		pipeline[5]["$group"].(bson.M)["sketches_"+name] = bson.M{"$push": "$" + name + ".sketch"}
+		pipeline[5]["$group"].(bson.M)["hlls_"+name] = bson.M{"$push": "$" + name + ".hll"}
+
+		// add project fields
+		pipeline[6]["$project"].(bson.M)["metrics"].(bson.M)[name] = bson.M{
+			"max":      "$max_" + name,
+			"min":      "$min_" + name,
+			"num":      "$num_" + name,
+			"sum":      "$sum_" + name,
+			"sumsq":    "$sumsq_" + name,
+			"first":    "$first_" + name,
+			"last":     "$last_" + name,
+			"sketches": "$sketches_" + name,
+			"hlls":     "$hlls_" + name,
+		}
+	}
+
+	return pipeline
+}
+
+func setsPipeline(query Query) []bson.M {
+	// prepare aggregation pipeline
+	pipeline := []bson.M{
+		// get all matching sets
+		{
+			"$match": matchSets(query),
+		},
+		// group samples
+		{
+			"$group": bson.M{
+				"_id": "$start",
+				// more fields added below
+			},
+		},
+		// finalize layout
+		{
+			"$project": bson.M{
+				"_id":     false,
+				"start":   "$_id",
+				"metrics": bson.M{
+					// fields added below
+				},
+			},
+		},
+		// sort samples
+		{
+			"$sort": bson.M{"start": 1},
+		},
+	}
+
+	// group by tags
+	if len(query.GroupBy) > 0 {
+		pipeline[1]["$group"].(bson.M)["_id"] = bson.M{"start": "$start", "tags": groupTags(query.GroupBy)}
+		pipeline[2]["$project"].(bson.M)["start"] = "$_id.start"
+		pipeline[2]["$project"].(bson.M)["tags"] = "$_id.tags"
+	}
+
+	// update pipeline
+	for _, name := range query.Metrics {
+		// add group fields
+		pipeline[1]["$group"].(bson.M)["max_"+name] = bson.M{"$max": "$max." + name}
+		pipeline[1]["$group"].(bson.M)["min_"+name] = bson.M{"$min": "$min." + name}
+		pipeline[1]["$group"].(bson.M)["num_"+name] = bson.M{"$sum": "$num." + name}
+		pipeline[1]["$group"].(bson.M)["sum_"+name] = bson.M{"$sum": "$sum." + name}
+		pipeline[1]["$group"].(bson.M)["sumsq_"+name] = bson.M{"$sum": "$sumsq." + name}
+		pipeline[1]["$group"].(bson.M)["first_"+name] = bson.M{"$min": "$first." + name}
+		pipeline[1]["$group"].(bson.M)["last_"+name] = bson.M{"$max": "$last." + name}
+		pipeline[1]["$group"].(bson.M)["sketches_"+name] = bson.M{"$push": "$sketch." + name}
+		pipeline[1]["$group"].(bson.M)["hlls_"+name] = bson.M{"$push": "$hll." + name}
+
+		// add project fields
+		pipeline[2]["$project"].(bson.M)["metrics"].(bson.M)[name] = bson.M{
+			"max":      "$max_" + name,
+			"min":      "$min_" + name,
+			"num":      "$num_" + name,
+			"sum":      "$sum_" + name,
+			"sumsq":    "$sumsq_" + name,
+			"first":    "$first_" + name,
+			"last":     "$last_" + name,
+			"sketches": "$sketches_" + name,
+			"hlls":     "$hlls_" + name,
+		}
+	}
+
+	return pipeline
+}
+
+func bucketStart(step time.Duration, loc *time.Location) bson.M {
+	// align to the Unix epoch if the location is missing
+	if loc == nil {
+		// subtract the offset of the start within its bucket
+		return bson.M{
+			"$subtract": []interface{}{
+				"$start",
+				bson.M{
+					"$mod": []interface{}{
+						bson.M{"$subtract": []interface{}{"$start", time.Unix(0, 0)}},
+						int64(step / time.Millisecond),
+					},
+				},
+			},
+		}
+	}
+
+	// get local date parts
+	zone := loc.String()
+	part := func(operator string) bson.M {
+		return bson.M{operator: bson.M{"date": "$start", "timezone": zone}}
+	}
+
+	// bucket multi-day steps by the number of local days since the epoch
+	if step >= 24*time.Hour {
+		// get local day number
+		days := bson.M{
+			"$divide": []interface{}{
+				bson.M{"$subtract": []interface{}{
+					bson.M{"$dateFromParts": bson.M{
+						"year":  part("$year"),
+						"month": part("$month"),
+						"day":   part("$dayOfMonth"),
+					}},
+					time.Unix(0, 0),
+				}},
+				int64(24 * time.Hour / time.Millisecond),
+			},
+		}
+
+		// subtract the offset of the day within its bucket
+		return bson.M{
+			"$dateFromParts": bson.M{
+				"year":  part("$year"),
+				"month": part("$month"),
+				"day": bson.M{"$subtract": []interface{}{
+					part("$dayOfMonth"),
+					bson.M{"$mod": []interface{}{days, int64(step / (24 * time.Hour))}},
+				}},
+				"timezone": zone,
+			},
+		}
+	}
+
+	// get local wall clock time of day in milliseconds
+	wall := bson.M{
+		"$add": []interface{}{
+			bson.M{"$multiply": []interface{}{part("$hour"), int64(time.Hour / time.Millisecond)}},
+			bson.M{"$multiply": []interface{}{part("$minute"), int64(time.Minute / time.Millisecond)}},
+			bson.M{"$multiply": []interface{}{part("$second"), int64(time.Second / time.Millisecond)}},
+			part("$millisecond"),
+		},
+	}
+
+	// get milliseconds to subtract from the wall clock time
+	offset := bson.M{
+		"$mod": []interface{}{wall, int64(step / time.Millisecond)},
+	}
+
+	// bucket sub-day steps by the local wall clock time, the offset is
+	// subtracted from the parts as they only accept small values
+	return bson.M{
+		"$let": bson.M{
+			"vars": bson.M{
+				"offset": offset,
+			},
+			"in": bson.M{
+				"$dateFromParts": bson.M{
+					"year":  part("$year"),
+					"month": part("$month"),
+					"day":   part("$dayOfMonth"),
+					"hour": bson.M{"$subtract": []interface{}{
+						part("$hour"),
+						bson.M{"$trunc": bson.M{"$divide": []interface{}{"$$offset", int64(time.Hour / time.Millisecond)}}},
+					}},
+					"minute": bson.M{"$subtract": []interface{}{
+						part("$minute"),
+						bson.M{"$trunc": bson.M{"$divide": []interface{}{
+							bson.M{"$mod": []interface{}{"$$offset", int64(time.Hour / time.Millisecond)}},
+							int64(time.Minute / time.Millisecond),
+						}}},
+					}},
+					"second": bson.M{"$subtract": []interface{}{
+						part("$second"),
+						bson.M{"$trunc": bson.M{"$divide": []interface{}{
+							bson.M{"$mod": []interface{}{"$$offset", int64(time.Minute / time.Millisecond)}},
+							int64(time.Second / time.Millisecond),
+						}}},
+					}},
+					"millisecond": bson.M{"$subtract": []interface{}{
+						part("$millisecond"),
+						bson.M{"$mod": []interface{}{"$$offset", int64(time.Second / time.Millisecond)}},
+					}},
+					"timezone": zone,
+				},
+			},
+		},
+	}
+}
+
+func groupTags(keys []string) bson.M {
+	// prepare document
+	doc := make(bson.M, len(keys))
+	for _, key := range keys {
+		doc[key] = "$tags." + key
+	}
+
+	return doc
+}
+
+type pipelineName struct {
+	Name string `bson:"_id"`
+}
+
+func metricsPipeline(query Query) []bson.M {
+	return []bson.M{
+		// get all matching sets
+		{
+			"$match": matchSets(query),
+		},
+		// get names of counted and distinct metrics
+		{
+			"$project": bson.M{
+				"_id": false,
+				"names": bson.M{
+					"$concatArrays": []interface{}{
+						bson.M{"$objectToArray": bson.M{"$ifNull": []interface{}{"$num", bson.M{}}}},
+						bson.M{"$objectToArray": bson.M{"$ifNull": []interface{}{"$hll", bson.M{}}}},
+					},
+				},
+			},
+		},
+		// unwind names
+		{
+			"$unwind": "$names",
+		},
+		// group names
+		{
+			"$group": bson.M{
+				"_id": "$names.k",
+			},
+		},
+	}
+}
+
+type pipelineSeries struct {
+	Tags bson.M `bson:"tags"`
+}
+
+func seriesPipeline(query Query) []bson.M {
+	return []bson.M{
+		// get all matching sets
+		{
+			"$match": matchSets(query),
+		},
+		// group sets by series
+		{
+			"$group": bson.M{
+				"_id":  "$series",
+				"tags": bson.M{"$first": "$tags"},
+			},
+		},
+	}
+}
+
+func pipelineSeriesTags(series []pipelineSeries) []bson.M {
+	// collect tags
+	list := make([]bson.M, 0, len(series))
+	for _, s := range series {
+		list = append(list, s.Tags)
+	}
+
+	return list
+}
+
+func tagKeysPipeline(query Query) []bson.M {
+	return []bson.M{
+		// get all matching sets
+		{
+			"$match": matchSets(query),
+		},
+		// get tag keys
+		{
+			"$project": bson.M{
+				"_id": false,
+				"keys": bson.M{
+					"$objectToArray": bson.M{"$ifNull": []interface{}{"$tags", bson.M{}}},
+				},
+			},
+		},
+		// unwind keys
+		{
+			"$unwind": "$keys",
+		},
+		// group keys
+		{
+			"$group": bson.M{
+				"_id": "$keys.k",
+			},
+		},
+	}
+}
+
+func pipelineNames(names []pipelineName) []string {
+	// collect names
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		list = append(list, name.Name)
+	}
+
+	return list
+}
+
+type pipelineStart struct {
+	Start time.Time `bson:"_id"`
+}
+
+func startsPipeline(query Query, limit int) []bson.M {
+	// prepare matcher
+	match := matchSets(query)
+
+	// require one of the metrics
+	list := make([]bson.M, 0, len(query.Metrics)*2)
+	for _, name := range query.Metrics {
+		list = append(list, bson.M{"num." + name: bson.M{"$gt": 0}})
+		list = append(list, bson.M{"hll." + name: bson.M{"$exists": true}})
+	}
+	match["$and"] = []bson.M{{"$or": list}}
+
+	return []bson.M{
+		// get all matching sets
+		{
+			"$match": match,
+		},
+		// group starts
+		{
+			"$group": bson.M{
+				"_id": "$start",
+			},
+		},
+		// sort starts backwards
+		{
+			"$sort": bson.M{"_id": -1},
+		},
+		// limit starts
+		{
+			"$limit": limit,
+		},
+	}
+}
+
+func pipelineStarts(starts []pipelineStart) []time.Time {
+	// collect starts
+	list := make([]time.Time, 0, len(starts))
+	for _, start := range starts {
+		list = append(list, start.Start)
+	}
+
+	return list
+}
+
+func matchSets(query Query) bson.M {
+	// create basic matcher
+	match := bson.M{
+		"start": bson.M{
+			"$gte": query.FirstSet,
+			"$lte": query.LastSet,
+		},
+	}
+
+	// add tags
+	for key, value := range matchTags(query.Tags) {
+		match[key] = value
+	}
+
+	// add exclusions
+	if len(query.Exclude) > 0 {
+		nor := make([]bson.M, 0, len(query.Exclude))
+		for _, tags := range query.Exclude {
+			nor = append(nor, matchTags(tags))
+		}
+
+		match["$nor"] = nor
+	}
+
+	return match
+}
+
+var recomputedFields = []struct {
+	field    string
+	operator string
+}{
+	{field: "max", operator: "$max"},
+	{field: "min", operator: "$min"},
+	{field: "num", operator: "$sum"},
+	{field: "sum", operator: "$sum"},
+	{field: "sumsq", operator: "$sum"},
+	{field: "first", operator: "$min"},
+	{field: "last", operator: "$max"},
+}
+
+func recomputeSetStage(metrics []string) bson.M {
+	// prepare fields
+	fields := bson.M{}
+
+	// recompute set level fields from all samples
+	for _, name := range metrics {
+		for _, f := range recomputedFields {
+			fields[f.field+"."+name] = bson.M{
+				f.operator: bson.M{
+					"$map": bson.M{
+						"input": bson.M{"$objectToArray": "$samples"},
+						"as":    "sample",
+						"in":    "$$sample.v." + name + "." + f.field,
+					},
+				},
+			}
+		}
+	}
+
+	return bson.M{"$set": fields}
+}
+
+func recomputeAllSetStage() bson.M {
+	// prepare fields
+	fields := bson.M{}
+
+	// recompute set level fields of all metrics from all samples
+	for _, f := range recomputedFields {
+		fields[f.field] = bson.M{
+			"$arrayToObject": bson.M{
+				"$map": bson.M{
+					"input": bson.M{"$objectToArray": bson.M{"$ifNull": []interface{}{"$" + f.field, bson.M{}}}},
+					"as":    "metric",
+					"in": bson.M{
+						"k": "$$metric.k",
+						"v": bson.M{
+							f.operator: bson.M{
+								"$map": bson.M{
+									"input": bson.M{"$objectToArray": "$samples"},
+									"as":    "sample",
+									"in": bson.M{
+										// the metric is looked up by name as
+										// its field is not known upfront
+										"$let": bson.M{
+											"vars": bson.M{
+												"values": bson.M{
+													"$arrayElemAt": []interface{}{
+														bson.M{
+															"$filter": bson.M{
+																"input": bson.M{"$objectToArray": "$$sample.v"},
+																"as":    "entry",
+																"cond":  bson.M{"$eq": []interface{}{"$$entry.k", "$$metric.k"}},
+															},
+														},
+														0,
+													},
+												},
+											},
+											"in": "$$values.v." + f.field,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	return bson.M{"$set": fields}
+}
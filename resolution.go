@@ -35,6 +35,40 @@ type Resolution interface {
 	SampleTimestamps(first, last time.Time) []time.Time
 }
 
+// A DurationResolution is a Resolution that can directly return the duration of
+// its samples. The duration of samples of other resolutions is derived from
+// their sample timestamps.
+type DurationResolution interface {
+	Resolution
+
+	// SampleDuration should return the duration of the sample that includes the
+	// given time.
+	SampleDuration(t time.Time) time.Duration
+}
+
+// the longest sample that is searched for resolutions without durations
+const maxSampleDuration = 366 * 24 * time.Hour
+
+func sampleDuration(res Resolution, t time.Time) time.Duration {
+	// use duration if available
+	if dr, ok := res.(DurationResolution); ok {
+		return dr.SampleDuration(t)
+	}
+
+	// get sample
+	sample := res.SampleTimestamp(t)
+
+	// widen range until the next sample is found
+	for d := time.Second; d <= maxSampleDuration; d *= 2 {
+		list := res.SampleTimestamps(sample, sample.Add(d))
+		if len(list) > 1 {
+			return list[1].Sub(list[0])
+		}
+	}
+
+	return maxSampleDuration
+}
+
 // BasicResolution defines the granularity of the saved metrics.
 type BasicResolution int
 
@@ -105,17 +139,20 @@ func (r BasicResolution) SetSize() int {
 func (r BasicResolution) SetTimestamp(t time.Time) time.Time {
 	var ts time.Time
 
+	// minutes and hours are truncated relative to the wall clock to keep
+	// repeated hours separate when daylight saving time ends
+
 	switch r {
 	case OneMinuteOf60Seconds:
-		ts = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+		ts = truncateSeconds(t)
 	case OneHourOf60Minutes:
-		ts = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		ts = truncateMinutes(t)
 	case OneDayOf24Hours:
 		ts = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
 	case OneMonthOfUpTo31Days:
 		ts = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
 	case OneHourOf3600Seconds:
-		ts = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		ts = truncateMinutes(t)
 	case OneDayOf1440Minutes:
 		ts = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
 	}
@@ -151,7 +188,9 @@ func (r BasicResolution) SetTimestamps(first, last time.Time) []time.Time {
 	return list
 }
 
-// SampleKey will return the sample key for given time.
+// SampleKey will return the sample key for given time. The hours and minutes
+// of a day are counted from the start of the day to support days that are
+// shorter or longer due to daylight saving time.
 func (r BasicResolution) SampleKey(t time.Time) string {
 	var key string
 
@@ -161,13 +200,13 @@ func (r BasicResolution) SampleKey(t time.Time) string {
 	case OneHourOf60Minutes:
 		key = strconv.Itoa(t.Minute())
 	case OneDayOf24Hours:
-		key = strconv.Itoa(t.Hour())
+		key = strconv.Itoa(int(r.SampleTimestamp(t).Sub(r.SetTimestamp(t)) / time.Hour))
 	case OneMonthOfUpTo31Days:
 		key = strconv.Itoa(t.Day())
 	case OneHourOf3600Seconds:
 		key = strconv.Itoa(t.Minute()*60 + t.Second())
 	case OneDayOf1440Minutes:
-		key = strconv.Itoa(t.Hour()*60 + t.Minute())
+		key = strconv.Itoa(int(r.SampleTimestamp(t).Sub(r.SetTimestamp(t)) / time.Minute))
 	}
 
 	return key
@@ -179,17 +218,17 @@ func (r BasicResolution) SampleTimestamp(t time.Time) time.Time {
 
 	switch r {
 	case OneMinuteOf60Seconds:
-		ts = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+		ts = truncateNanoseconds(t)
 	case OneHourOf60Minutes:
-		ts = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+		ts = truncateSeconds(t)
 	case OneDayOf24Hours:
-		ts = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		ts = truncateMinutes(t)
 	case OneMonthOfUpTo31Days:
 		ts = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
 	case OneHourOf3600Seconds:
-		ts = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+		ts = truncateNanoseconds(t)
 	case OneDayOf1440Minutes:
-		ts = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+		ts = truncateSeconds(t)
 	}
 
 	return ts
@@ -203,22 +242,100 @@ func (r BasicResolution) SampleTimestamps(first, last time.Time) []time.Time {
 
 	for curSample.Before(last) || curSample.Equal(last) {
 		list = append(list, curSample)
-
-		switch r {
-		case OneMinuteOf60Seconds:
-			curSample = curSample.Add(1 * time.Second)
-		case OneHourOf60Minutes:
-			curSample = curSample.Add(1 * time.Minute)
-		case OneDayOf24Hours:
-			curSample = curSample.Add(1 * time.Hour)
-		case OneMonthOfUpTo31Days:
-			curSample = curSample.AddDate(0, 0, 1)
-		case OneHourOf3600Seconds:
-			curSample = curSample.Add(1 * time.Second)
-		case OneDayOf1440Minutes:
-			curSample = curSample.Add(1 * time.Minute)
-		}
+		curSample = r.nextSample(curSample)
 	}
 
 	return list
 }
+
+// SampleDuration will return the duration of the sample that includes the
+// given time.
+func (r BasicResolution) SampleDuration(t time.Time) time.Duration {
+	sample := r.SampleTimestamp(t)
+	return r.nextSample(sample).Sub(sample)
+}
+
+func (r BasicResolution) nextSample(t time.Time) time.Time {
+	var ts time.Time
+
+	switch r {
+	case OneMinuteOf60Seconds:
+		ts = t.Add(1 * time.Second)
+	case OneHourOf60Minutes:
+		ts = t.Add(1 * time.Minute)
+	case OneDayOf24Hours:
+		ts = t.Add(1 * time.Hour)
+	case OneMonthOfUpTo31Days:
+		ts = t.AddDate(0, 0, 1)
+	case OneHourOf3600Seconds:
+		ts = t.Add(1 * time.Second)
+	case OneDayOf1440Minutes:
+		ts = t.Add(1 * time.Minute)
+	}
+
+	return ts
+}
+
+func truncateNanoseconds(t time.Time) time.Time {
+	// strip monotonic clock reading
+	t = t.Round(0)
+
+	return t.Add(-time.Duration(t.Nanosecond()))
+}
+
+func truncateSeconds(t time.Time) time.Time {
+	return truncateNanoseconds(t).Add(-time.Duration(t.Second()) * time.Second)
+}
+
+func truncateMinutes(t time.Time) time.Time {
+	return truncateSeconds(t).Add(-time.Duration(t.Minute()) * time.Minute)
+}
+
+type zonedResolution struct {
+	res Resolution
+	loc *time.Location
+}
+
+// InLocation will return a resolution that converts all times to the specified
+// location before they are passed to the specified resolution. This ensures
+// that sets and samples are aligned in the same location regardless of the
+// location of the times passed by callers.
+func InLocation(res Resolution, loc *time.Location) Resolution {
+	return &zonedResolution{res: res, loc: loc}
+}
+
+func (r *zonedResolution) Split(t time.Time) (time.Time, string) {
+	return r.res.Split(t.In(r.loc))
+}
+
+func (r *zonedResolution) Join(t time.Time, key string) time.Time {
+	return r.res.Join(t.In(r.loc), key)
+}
+
+func (r *zonedResolution) SetSize() int {
+	return r.res.SetSize()
+}
+
+func (r *zonedResolution) SetTimestamp(t time.Time) time.Time {
+	return r.res.SetTimestamp(t.In(r.loc))
+}
+
+func (r *zonedResolution) SetTimestamps(first, last time.Time) []time.Time {
+	return r.res.SetTimestamps(first.In(r.loc), last.In(r.loc))
+}
+
+func (r *zonedResolution) SampleKey(t time.Time) string {
+	return r.res.SampleKey(t.In(r.loc))
+}
+
+func (r *zonedResolution) SampleTimestamp(t time.Time) time.Time {
+	return r.res.SampleTimestamp(t.In(r.loc))
+}
+
+func (r *zonedResolution) SampleTimestamps(first, last time.Time) []time.Time {
+	return r.res.SampleTimestamps(first.In(r.loc), last.In(r.loc))
+}
+
+func (r *zonedResolution) SampleDuration(t time.Time) time.Duration {
+	return sampleDuration(r.res, t.In(r.loc))
+}
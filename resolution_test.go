@@ -1,6 +1,7 @@
 package mgots
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
@@ -200,3 +201,98 @@ func TestBasicResolutionSampleTimestamps(t *testing.T) {
 		assert.Equal(t, e.last, list[e.len-1].Format(time.Stamp), "%d", i)
 	}
 }
+
+func TestBasicResolutionSampleDuration(t *testing.T) {
+	ts := parseTime("Jul 15 15:15:15")
+
+	table := []struct {
+		r DurationResolution
+		d time.Duration
+	}{
+		{r: OneMinuteOf60Seconds, d: time.Second},
+		{r: OneHourOf60Minutes, d: time.Minute},
+		{r: OneDayOf24Hours, d: time.Hour},
+		{r: OneMonthOfUpTo31Days, d: 24 * time.Hour},
+		{r: OneHourOf3600Seconds, d: time.Second},
+		{r: OneDayOf1440Minutes, d: time.Minute},
+	}
+
+	for i, e := range table {
+		assert.Equal(t, e.d, e.r.SampleDuration(ts), "%d", i)
+		assert.Equal(t, e.d, sampleDuration(plainResolution{e.r}, ts), "%d", i)
+	}
+}
+
+type plainResolution struct {
+	Resolution
+}
+
+func TestBasicResolutionDaylightSavingTime(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Zurich")
+	assert.NoError(t, err)
+
+	// daylight saving time ends at 03:00 CEST
+	day := time.Date(2017, 10, 29, 0, 0, 0, 0, loc)
+	for i := 0; i < 25; i++ {
+		ts := day.Add(time.Duration(i)*time.Hour + 30*time.Minute)
+
+		start, key := OneDayOf24Hours.Split(ts)
+		assert.True(t, day.Equal(start), "%d", i)
+		assert.Equal(t, strconv.Itoa(i), key, "%d", i)
+		assert.True(t, ts.Add(-30*time.Minute).Equal(OneDayOf24Hours.Join(start, key)), "%d", i)
+		assert.Equal(t, time.Hour, OneDayOf24Hours.SampleDuration(ts), "%d", i)
+
+		set := OneHourOf60Minutes.SetTimestamp(ts)
+		assert.True(t, ts.Add(-30*time.Minute).Equal(set), "%d", i)
+	}
+
+	assert.Len(t, OneDayOf24Hours.SampleTimestamps(day, day.AddDate(0, 0, 1).Add(-time.Second)), 25)
+	assert.Len(t, OneDayOf1440Minutes.SampleTimestamps(day, day.AddDate(0, 0, 1).Add(-time.Second)), 1500)
+	assert.Equal(t, 25*time.Hour, OneMonthOfUpTo31Days.SampleDuration(day))
+
+	// daylight saving time starts at 02:00 CET
+	day = time.Date(2017, 3, 26, 0, 0, 0, 0, loc)
+	for i := 0; i < 23; i++ {
+		ts := day.Add(time.Duration(i)*time.Hour + 30*time.Minute)
+
+		start, key := OneDayOf24Hours.Split(ts)
+		assert.True(t, day.Equal(start), "%d", i)
+		assert.Equal(t, strconv.Itoa(i), key, "%d", i)
+		assert.True(t, ts.Add(-30*time.Minute).Equal(OneDayOf24Hours.Join(start, key)), "%d", i)
+	}
+
+	assert.Len(t, OneDayOf24Hours.SampleTimestamps(day, day.AddDate(0, 0, 1).Add(-time.Second)), 23)
+	assert.Equal(t, 23*time.Hour, OneMonthOfUpTo31Days.SampleDuration(day))
+	assert.Equal(t, 23*time.Hour, sampleDuration(plainResolution{OneMonthOfUpTo31Days}, day))
+	assert.Equal(t, []time.Time{day, day.AddDate(0, 0, 1)}, OneDayOf24Hours.SetTimestamps(day, day.Add(30*time.Hour)))
+}
+
+func TestInLocation(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Zurich")
+	assert.NoError(t, err)
+
+	res := InLocation(OneDayOf24Hours, loc)
+
+	ts := time.Date(2017, 7, 15, 23, 30, 0, 0, time.UTC)
+
+	start, key := res.Split(ts)
+	assert.Equal(t, time.Date(2017, 7, 16, 0, 0, 0, 0, loc), start)
+	assert.Equal(t, "1", key)
+	assert.True(t, time.Date(2017, 7, 15, 23, 0, 0, 0, time.UTC).Equal(res.Join(start, key)))
+	assert.Equal(t, start, res.SetTimestamp(ts.In(time.FixedZone("X", -8*3600))))
+	assert.Equal(t, "1", res.SampleKey(ts.In(time.FixedZone("X", -8*3600))))
+	assert.Equal(t, 24, res.SetSize())
+	assert.Len(t, res.SetTimestamps(ts, ts.Add(24*time.Hour)), 2)
+	assert.Len(t, res.SampleTimestamps(ts, ts.Add(2*time.Hour)), 3)
+	assert.Equal(t, time.Hour, sampleDuration(res, ts))
+	assert.Equal(t, time.Hour, sampleDuration(InLocation(plainResolution{OneDayOf24Hours}, loc), ts))
+
+	tsc := WrapBackend(NewMemoryBackend(), res)
+	assert.NoError(t, tsc.Insert(ts, map[string]float64{"value": 1}, nil))
+	assert.NoError(t, tsc.Insert(ts.In(time.FixedZone("X", -8*3600)), map[string]float64{"value": 2}, nil))
+
+	ts2, err := tsc.AggregateSets(ts, ts, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts2.Samples, 1)
+	assert.Equal(t, float64(3), ts2.Sum("value"))
+}
@@ -0,0 +1,140 @@
+package mgots
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// A RetentionPolicy defines how long the sets of the series matching the tags
+// are retained.
+type RetentionPolicy struct {
+	// The tags that must match. Empty tags match all series.
+	Tags bson.M
+
+	// The duration for which sets are retained. Zero means forever.
+	Retention time.Duration
+}
+
+// Sweep will remove all sets whose start falls behind the retention of their
+// policy at the specified time. The policies are evaluated in order and only
+// the first policy matching a series applies, which allows ending the list with
+// a default policy. Series that match no policy are retained. It will return
+// the number of removed sets.
+func (c *Collection) Sweep(now time.Time, policies []RetentionPolicy) (int, error) {
+	return c.SweepContext(context.Background(), now, policies)
+}
+
+// SweepContext will remove all expired sets like Sweep but abort when the
+// deadline of the context is exceeded or, if supported by the backend, when
+// the context is cancelled. The context error is returned in that case together
+// with the number of sets removed until then.
+func (c *Collection) SweepContext(ctx context.Context, now time.Time, policies []RetentionPolicy) (int, error) {
+	// prepare counter
+	var removed int
+
+	// apply policies
+	for i, policy := range policies {
+		// skip unlimited retention
+		if policy.Retention <= 0 {
+			continue
+		}
+
+		// remove expired sets not matched by an earlier policy
+		n, err := c.backend.Remove(ctx, Query{
+			FirstSet: time.Time{},
+			LastSet:  now.Add(-policy.Retention - time.Nanosecond),
+			Tags:     policy.Tags,
+			Exclude:  policyTags(policies[:i]),
+		})
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+func policyTags(policies []RetentionPolicy) []bson.M {
+	// collect tags
+	list := make([]bson.M, 0, len(policies))
+	for _, policy := range policies {
+		list = append(list, policy.Tags)
+	}
+
+	return list
+}
+
+// A Sweeper periodically enforces retention policies in the background.
+type Sweeper struct {
+	coll     *Collection
+	policies []RetentionPolicy
+	interval time.Duration
+	reporter func(int, error)
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewSweeper will return a new sweeper that sweeps the collection immediately
+// and then every interval. A zero or negative interval sweeps the collection
+// only once. The number of removed sets and errors of every sweep are passed to
+// the reporter if available.
+func NewSweeper(coll *Collection, policies []RetentionPolicy, interval time.Duration, reporter func(int, error)) *Sweeper {
+	// prepare sweeper
+	s := &Sweeper{
+		coll:     coll,
+		policies: policies,
+		interval: interval,
+		reporter: reporter,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	// run sweeper
+	go s.run()
+
+	return s
+}
+
+// Close will stop the sweeper and wait until a running sweep has completed.
+func (s *Sweeper) Close() {
+	// stop sweeper
+	s.once.Do(func() {
+		close(s.stop)
+	})
+
+	// await exit
+	<-s.done
+}
+
+func (s *Sweeper) run() {
+	// signal when done
+	defer close(s.done)
+
+	// prepare ticker if enabled
+	var tick <-chan time.Time
+	if s.interval > 0 {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		// sweep collection
+		removed, err := s.coll.Sweep(time.Now(), s.policies)
+		if s.reporter != nil {
+			s.reporter(removed, err)
+		}
+
+		select {
+		case <-tick:
+		case <-s.stop:
+			return
+		}
+	}
+}
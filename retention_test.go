@@ -0,0 +1,101 @@
+package mgots
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectionSweep(t *testing.T) {
+	testCollectionSweep(t, WrapBackend(NewMemoryBackend(), OneDayOf24Hours))
+}
+
+func TestCollectionSweepMongo(t *testing.T) {
+	requireMongo(t)
+
+	testCollectionSweep(t, Wrap(db.C("test-coll-sweep"), OneDayOf24Hours))
+}
+
+func TestCollectionSweepDriver(t *testing.T) {
+	requireMongo(t)
+
+	testCollectionSweep(t, WrapDriver(driverDB.Collection("test-driver-sweep"), OneDayOf24Hours))
+}
+
+func testCollectionSweep(t *testing.T, tsc *Collection) {
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 10; i++ {
+		for _, tenant := range []string{"free", "paid", "other"} {
+			err := tsc.Insert(now.AddDate(0, 0, -i), map[string]float64{
+				"value": 1,
+			}, bson.M{"tenant": tenant})
+			assert.NoError(t, err)
+		}
+	}
+
+	policies := []RetentionPolicy{
+		{Tags: bson.M{"tenant": "free"}, Retention: 3 * 24 * time.Hour},
+		{Tags: bson.M{"tenant": "paid"}},
+		{Retention: 7 * 24 * time.Hour},
+	}
+
+	removed, err := tsc.Sweep(now, policies)
+	assert.NoError(t, err)
+	assert.Equal(t, 7+3, removed)
+
+	removed, err = tsc.Sweep(now, policies)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	first := now.AddDate(0, 0, -10)
+
+	for tenant, num := range map[string]int64{"free": 3, "paid": 10, "other": 7} {
+		ts, err := tsc.AggregateSets(first, now, []string{"value"}, bson.M{"tenant": tenant})
+		assert.NoError(t, err)
+		assert.Equal(t, num, ts.Num("value"), tenant)
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	err := tsc.Insert(time.Now().Add(-time.Hour), map[string]float64{
+		"value": 1,
+	}, nil)
+	assert.NoError(t, err)
+
+	reports := make(chan int, 10)
+	s := NewSweeper(tsc, []RetentionPolicy{
+		{Retention: time.Minute},
+	}, time.Hour, func(removed int, err error) {
+		assert.NoError(t, err)
+		reports <- removed
+	})
+
+	assert.Equal(t, 1, <-reports)
+	s.Close()
+}
+
+func TestSweeperZeroInterval(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+
+	err := tsc.Insert(time.Now().Add(-time.Hour), map[string]float64{
+		"value": 1,
+	}, nil)
+	assert.NoError(t, err)
+
+	reports := make(chan int, 10)
+	s := NewSweeper(tsc, []RetentionPolicy{
+		{Retention: time.Minute},
+	}, 0, func(removed int, err error) {
+		assert.NoError(t, err)
+		reports <- removed
+	})
+
+	assert.Equal(t, 1, <-reports)
+	s.Close()
+	assert.Empty(t, reports)
+}
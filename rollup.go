@@ -0,0 +1,325 @@
+package mgots
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// A CheckpointStore persists the progress of rollups.
+type CheckpointStore interface {
+	// Load should return the checkpoint of the specified rollup or the zero
+	// time if none has been saved yet.
+	Load(name string) (time.Time, error)
+
+	// Save should persist the checkpoint of the specified rollup.
+	Save(name string, checkpoint time.Time) error
+}
+
+// MemoryCheckpointStore is a CheckpointStore that keeps checkpoints in memory.
+type MemoryCheckpointStore struct {
+	checkpoints map[string]time.Time
+	mutex       sync.Mutex
+}
+
+// NewMemoryCheckpointStore will return a new memory checkpoint store.
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{
+		checkpoints: map[string]time.Time{},
+	}
+}
+
+// Load implements the CheckpointStore interface.
+func (s *MemoryCheckpointStore) Load(name string) (time.Time, error) {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.checkpoints[name], nil
+}
+
+// Save implements the CheckpointStore interface.
+func (s *MemoryCheckpointStore) Save(name string, checkpoint time.Time) error {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// set checkpoint
+	s.checkpoints[name] = checkpoint
+
+	return nil
+}
+
+type mgoCheckpointStore struct {
+	coll *mgo.Collection
+}
+
+// WrapCheckpointStore will take a mgo.Collection and return a CheckpointStore
+// that stores one document per rollup.
+func WrapCheckpointStore(coll *mgo.Collection) CheckpointStore {
+	return &mgoCheckpointStore{coll: coll}
+}
+
+func (s *mgoCheckpointStore) Load(name string) (time.Time, error) {
+	// find checkpoint
+	var doc struct {
+		Checkpoint time.Time `bson:"checkpoint"`
+	}
+	err := s.coll.FindId(name).One(&doc)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return doc.Checkpoint, nil
+}
+
+func (s *mgoCheckpointStore) Save(name string, checkpoint time.Time) error {
+	// upsert checkpoint
+	_, err := s.coll.UpsertId(name, bson.M{
+		"$set": bson.M{
+			"checkpoint": checkpoint,
+		},
+	})
+
+	return err
+}
+
+// ErrInvalidSeries is returned if the series of a rollup contain tags that are
+// not literal values like matchers, Or or Exact.
+var ErrInvalidSeries = errors.New("mgots: rollup series must only contain literal tags")
+
+// A Rollup merges the samples of a fine-grained source collection into the
+// samples of a coarser target collection. Only target samples that have been
+// closed are rolled up. Every target sample is replaced with the merged source
+// samples, which ensures that a repeated rollup never counts values twice.
+//
+// Note: Rollups require MongoDB 4.2 or newer. Sketches and distinct counts are
+// not rolled up.
+type Rollup struct {
+	// The unique name used to store the checkpoint.
+	Name string
+
+	// The source and target collection.
+	Source *Collection
+	Target *Collection
+
+	// The metrics that are rolled up.
+	Metrics []string
+
+	// The tags of the series that are rolled up separately. The samples of all
+	// series matching the tags are merged and written using the tags. The tags
+	// must therefore only contain literal values and no matchers, Or or Exact.
+	// If empty, all series are merged into a single series without tags.
+	Series []bson.M
+
+	// The store used to persist the checkpoint.
+	Store CheckpointStore
+
+	// The time from which the first rollup starts if no checkpoint has been
+	// saved yet. If zero, only samples closed after the first run are rolled
+	// up.
+	Start time.Time
+}
+
+// Run will roll up all target samples that have been closed since the last
+// checkpoint at the specified time and save a new checkpoint.
+func (r *Rollup) Run(now time.Time) error {
+	return r.RunContext(context.Background(), now)
+}
+
+// RunContext will roll up all closed target samples like Run but abort when the
+// deadline of the context is exceeded or, if supported by the backend, when the
+// context is cancelled. The context error is returned in that case and the
+// checkpoint is not saved.
+func (r *Rollup) RunContext(ctx context.Context, now time.Time) error {
+	// check series
+	for _, tags := range r.Series {
+		if !literalTags(tags) {
+			return ErrInvalidSeries
+		}
+	}
+
+	// get end of last closed target sample
+	end := r.Target.res.SampleTimestamp(now)
+
+	// load checkpoint
+	checkpoint, err := r.Store.Load(r.Name)
+	if err != nil {
+		return err
+	}
+
+	// use start if missing
+	if checkpoint.IsZero() {
+		checkpoint = r.Start
+	}
+
+	// save end if start is missing
+	if checkpoint.IsZero() {
+		return r.Store.Save(r.Name, end)
+	}
+
+	// align checkpoint
+	checkpoint = r.Target.res.SampleTimestamp(checkpoint)
+
+	// check range
+	if !checkpoint.Before(end) {
+		return nil
+	}
+
+	// prepare series
+	series := r.Series
+	if len(series) == 0 {
+		series = []bson.M{nil}
+	}
+
+	// prepare upserts
+	var upserts []Upsert
+
+	// roll up series
+	for _, tags := range series {
+		// aggregate source samples
+		ts, err := r.Source.AggregateSamplesContext(ctx, checkpoint, end.Add(-time.Nanosecond), r.Metrics, tags)
+		if err != nil {
+			return err
+		}
+
+		// prepare bulk
+		bulk := r.Target.Bulk()
+
+		// merge samples into target samples
+		for _, sample := range ts.Samples {
+			target := bulk.sample(sample.Start, tags)
+			for name, metric := range sample.Metrics {
+				// skip empty metrics
+				if metric.Num == 0 {
+					continue
+				}
+
+				// drop sketches, distinct counts and rates
+				metric = Metric{
+					Max:   metric.Max,
+					Min:   metric.Min,
+					Num:   metric.Num,
+					Sum:   metric.Sum,
+					SumSq: metric.SumSq,
+					First: metric.First,
+					Last:  metric.Last,
+				}
+
+				if existing, ok := target.metrics[name]; ok {
+					metric = existing.merge(metric)
+				}
+
+				target.metrics[name] = metric
+			}
+		}
+
+		// add replacements
+		for _, sample := range bulk.samples {
+			if len(sample.metrics) > 0 {
+				upserts = append(upserts, r.Target.replaceSample(sample.start, sample.key, sample.metrics, sample.tags))
+			}
+		}
+	}
+
+	// write samples
+	if len(upserts) > 0 {
+		err = r.Target.backend.Upsert(ctx, upserts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// save checkpoint
+	return r.Store.Save(r.Name, end)
+}
+
+func literalTags(tags bson.M) bool {
+	// check keys and values
+	for key, value := range tags {
+		if key == Or || key == seriesKey {
+			return false
+		}
+
+		switch value.(type) {
+		case Matcher, *Matcher:
+			return false
+		}
+	}
+
+	return true
+}
+
+// A RollupWorker periodically runs a rollup in the background.
+type RollupWorker struct {
+	rollup   *Rollup
+	interval time.Duration
+	reporter func(error)
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewRollupWorker will return a new worker that runs the rollup immediately and
+// then every interval. A zero or negative interval runs the rollup only once.
+// Errors are passed to the reporter if available.
+func NewRollupWorker(rollup *Rollup, interval time.Duration, reporter func(error)) *RollupWorker {
+	// prepare worker
+	w := &RollupWorker{
+		rollup:   rollup,
+		interval: interval,
+		reporter: reporter,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	// run worker
+	go w.run()
+
+	return w
+}
+
+// Close will stop the worker and wait until a running rollup has completed.
+func (w *RollupWorker) Close() {
+	// stop worker
+	w.once.Do(func() {
+		close(w.stop)
+	})
+
+	// await exit
+	<-w.done
+}
+
+func (w *RollupWorker) run() {
+	// signal when done
+	defer close(w.done)
+
+	// prepare ticker if enabled
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		// run rollup
+		err := w.rollup.Run(time.Now())
+		if err != nil && w.reporter != nil {
+			w.reporter(err)
+		}
+
+		select {
+		case <-tick:
+		case <-w.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package mgots
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollup(t *testing.T) {
+	source := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	target := WrapBackend(NewMemoryBackend(), OneHourOf60Minutes)
+	store := NewMemoryCheckpointStore()
+
+	rollup := &Rollup{
+		Name:    "minutes",
+		Source:  source,
+		Target:  target,
+		Metrics: []string{"value"},
+		Series:  []bson.M{{"host": "a"}, {"host": "b"}},
+		Store:   store,
+		Start:   parseTime("Jul 15 15:00:00"),
+	}
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 4; i++ {
+		for _, host := range []string{"a", "b"} {
+			err := source.Insert(now.Add(time.Duration(i)*10*time.Second), map[string]float64{
+				"value": float64(i),
+			}, bson.M{"host": host})
+			assert.NoError(t, err)
+		}
+	}
+
+	// sample still open
+	assert.NoError(t, rollup.Run(now.Add(30*time.Second)))
+
+	ts, err := target.AggregateSamples(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 0)
+
+	checkpoint, err := store.Load("minutes")
+	assert.NoError(t, err)
+	assert.Equal(t, parseTime("Jul 15 15:15:00"), checkpoint)
+
+	// sample closed twice
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, rollup.Run(now.Add(time.Minute)))
+	}
+
+	ts, err = target.AggregateSamples(now, now.Add(30*time.Second), []string{"value"}, bson.M{"host": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Sample{
+		{
+			Start: parseTime("Jul 15 15:15:00"),
+			Metrics: map[string]Metric{
+				"value": {
+					Max: 3, Min: 0, Num: 4, Sum: 6, SumSq: 14,
+					First: Point{Time: parseTime("Jul 15 15:15:15"), Value: 0},
+					Last:  Point{Time: parseTime("Jul 15 15:15:45"), Value: 3},
+					Rate:  0.1,
+				},
+			},
+		},
+	}, forceUTCTimeSeries(ts).Samples)
+
+	ts, err = target.AggregateSets(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), ts.Num("value"))
+	assert.Equal(t, float64(12), ts.Sum("value"))
+
+	checkpoint, err = store.Load("minutes")
+	assert.NoError(t, err)
+	assert.Equal(t, parseTime("Jul 15 15:16:00"), checkpoint)
+}
+
+func TestRollupInvalidSeries(t *testing.T) {
+	for _, tags := range []bson.M{
+		{"host": Regex("^a")},
+		{"host": In("a", "b")},
+		{Or: []bson.M{{"host": "a"}, {"host": "b"}}},
+		Exact(bson.M{"host": "a"}),
+	} {
+		target := WrapBackend(NewMemoryBackend(), OneHourOf60Minutes)
+
+		rollup := &Rollup{
+			Name:    "minutes",
+			Source:  WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds),
+			Target:  target,
+			Metrics: []string{"value"},
+			Series:  []bson.M{{"host": "c"}, tags},
+			Store:   NewMemoryCheckpointStore(),
+			Start:   parseTime("Jul 15 15:00:00"),
+		}
+
+		assert.Equal(t, ErrInvalidSeries, rollup.Run(parseTime("Jul 15 16:00:00")), "%v", tags)
+
+		series, err := target.Series(time.Time{}, time.Time{}, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, series)
+	}
+}
+
+func TestRollupWorker(t *testing.T) {
+	source := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	target := WrapBackend(&failingBackend{NewMemoryBackend()}, OneHourOf60Minutes)
+	store := NewMemoryCheckpointStore()
+
+	now := time.Now().Truncate(time.Minute).Add(-time.Minute)
+	assert.NoError(t, source.Insert(now, map[string]float64{
+		"value": 1,
+	}, nil))
+
+	errs := make(chan error, 10)
+	w := NewRollupWorker(&Rollup{
+		Name:    "minutes",
+		Source:  source,
+		Target:  target,
+		Metrics: []string{"value"},
+		Store:   store,
+		Start:   now,
+	}, time.Hour, func(err error) {
+		errs <- err
+	})
+
+	assert.Equal(t, errors.New("failed"), <-errs)
+	w.Close()
+
+	checkpoint, err := store.Load("minutes")
+	assert.NoError(t, err)
+	assert.True(t, checkpoint.IsZero())
+}
+
+func TestRollupWorkerZeroInterval(t *testing.T) {
+	source := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	target := WrapBackend(NewMemoryBackend(), OneHourOf60Minutes)
+	store := NewMemoryCheckpointStore()
+
+	errs := make(chan error, 10)
+	w := NewRollupWorker(&Rollup{
+		Name:    "minutes",
+		Source:  source,
+		Target:  target,
+		Metrics: []string{"value"},
+		Store:   store,
+	}, 0, func(err error) {
+		errs <- err
+	})
+	w.Close()
+
+	assert.Empty(t, errs)
+
+	checkpoint, err := store.Load("minutes")
+	assert.NoError(t, err)
+	assert.False(t, checkpoint.IsZero())
+}
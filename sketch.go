@@ -0,0 +1,130 @@
+package mgots
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// SketchAccuracy is the relative accuracy of the quantiles computed from a
+// Sketch.
+const SketchAccuracy = 0.01
+
+var sketchGamma = (1 + SketchAccuracy) / (1 - SketchAccuracy)
+
+var sketchLogGamma = math.Log(sketchGamma)
+
+// A Sketch is a mergeable quantile sketch. It counts values in logarithmically
+// sized buckets which allows computing quantiles with a relative accuracy of
+// SketchAccuracy. Positive values are counted under "p<index>", negative values
+// under "n<index>" and zeros under "z".
+type Sketch map[string]int64
+
+func newSketch(value float64) Sketch {
+	return Sketch{sketchKey(value): 1}
+}
+
+// Num returns the number of values counted in the sketch.
+func (s Sketch) Num() int64 {
+	var num int64
+
+	for _, count := range s {
+		num += count
+	}
+
+	return num
+}
+
+// Quantile returns the approximate value at the specified quantile (0-1).
+func (s Sketch) Quantile(q float64) float64 {
+	// check sketch
+	num := s.Num()
+	if num == 0 {
+		return 0
+	}
+
+	// prepare buckets
+	type bucket struct {
+		value float64
+		count int64
+	}
+
+	// collect buckets
+	buckets := make([]bucket, 0, len(s))
+	for key, count := range s {
+		buckets = append(buckets, bucket{value: sketchValue(key), count: count})
+	}
+
+	// sort buckets
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].value < buckets[j].value
+	})
+
+	// get rank
+	rank := math.Max(0, math.Min(1, q)) * float64(num-1)
+
+	// find bucket
+	var total int64
+	for _, b := range buckets {
+		total += b.count
+		if float64(total) > rank {
+			return b.value
+		}
+	}
+
+	return buckets[len(buckets)-1].value
+}
+
+func (s Sketch) merge(other Sketch) Sketch {
+	// check sketches
+	if s == nil && other == nil {
+		return nil
+	}
+
+	// merge counts
+	merged := make(Sketch, len(s)+len(other))
+	for key, count := range s {
+		merged[key] += count
+	}
+	for key, count := range other {
+		merged[key] += count
+	}
+
+	return merged
+}
+
+func sketchKey(value float64) string {
+	// handle zero
+	if value == 0 {
+		return "z"
+	}
+
+	// handle negative values
+	if value < 0 {
+		return "n" + strconv.Itoa(sketchIndex(-value))
+	}
+
+	return "p" + strconv.Itoa(sketchIndex(value))
+}
+
+func sketchIndex(value float64) int {
+	return int(math.Ceil(math.Log(value) / sketchLogGamma))
+}
+
+func sketchValue(key string) float64 {
+	// handle zero
+	if key == "z" || len(key) < 2 {
+		return 0
+	}
+
+	// get representative value of bucket
+	index, _ := strconv.Atoi(key[1:])
+	value := 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+
+	// handle negative values
+	if key[0] == 'n' {
+		return -value
+	}
+
+	return value
+}
@@ -0,0 +1,36 @@
+package mgots
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSketchQuantile(t *testing.T) {
+	var sketch Sketch
+	for i := 1; i <= 1000; i++ {
+		sketch = sketch.merge(newSketch(float64(i)))
+	}
+
+	assert.Equal(t, int64(1000), sketch.Num())
+
+	for _, q := range []float64{0, 0.5, 0.9, 0.95, 0.99, 1} {
+		expected := math.Max(1, q*1000)
+		assert.InEpsilon(t, expected, sketch.Quantile(q), SketchAccuracy*2, "%f", q)
+	}
+}
+
+func TestSketchNegativeAndZero(t *testing.T) {
+	sketch := Sketch{}
+	for _, value := range []float64{-100, -10, 0, 0, 10, 100} {
+		sketch = sketch.merge(newSketch(value))
+	}
+
+	assert.InEpsilon(t, -100, sketch.Quantile(0), SketchAccuracy)
+	assert.InEpsilon(t, -10, sketch.Quantile(0.2), SketchAccuracy)
+	assert.Equal(t, float64(0), sketch.Quantile(0.5))
+	assert.InEpsilon(t, 10, sketch.Quantile(0.8), SketchAccuracy)
+	assert.InEpsilon(t, 100, sketch.Quantile(1), SketchAccuracy)
+	assert.Equal(t, float64(0), Sketch(nil).Quantile(0.5))
+}
@@ -2,21 +2,103 @@ package mgots
 
 import (
 	"math"
+	"sort"
 	"time"
+
+	"github.com/globalsign/mgo/bson"
 )
 
+// A Point is a single measured value and its exact timestamp.
+type Point struct {
+	Time  time.Time `bson:"t"`
+	Value float64   `bson:"v"`
+}
+
+func (p Point) before(other Point) bool {
+	// sort by time and then by value
+	if !p.Time.Equal(other.Time) {
+		return p.Time.Before(other.Time)
+	}
+
+	return p.Value < other.Value
+}
+
 // A Metric is a single aggregated metric in a sample.
 type Metric struct {
-	Max float64
-	Min float64
-	Num int64
-	Sum float64
+	Max    float64
+	Min    float64
+	Num    int64
+	Sum    float64
+	SumSq  float64
+	First  Point
+	Last   Point
+	Sketch Sketch
+	HLL    HyperLogLog
+
+	// Rate is the per-second rate of the sum over the duration of the sample.
+	// It is only calculated by AggregateSamples.
+	Rate float64
+}
+
+// Variance returns the population variance of the measured values.
+func (m Metric) Variance() float64 {
+	return variance(m.Num, m.Sum, m.SumSq)
+}
+
+// StdDev returns the population standard deviation of the measured values.
+func (m Metric) StdDev() float64 {
+	return math.Sqrt(m.Variance())
+}
+
+// Quantile returns the approximate value at the specified quantile (0-1). It
+// requires that sketches have been enabled for the metric.
+func (m Metric) Quantile(q float64) float64 {
+	// check sketch
+	if m.Sketch.Num() == 0 {
+		return 0
+	}
+
+	// keep value within the measured range
+	return math.Max(m.Min, math.Min(m.Max, m.Sketch.Quantile(q)))
+}
+
+// Cardinality returns the estimated number of distinct values. It requires
+// that the values have been inserted using InsertDistinct.
+func (m Metric) Cardinality() float64 {
+	return m.HLL.Estimate()
+}
+
+func (m Metric) merge(other Metric) Metric {
+	// get range while ignoring metrics without values
+	max, min := math.Max(m.Max, other.Max), math.Min(m.Min, other.Min)
+	if m.Num == 0 {
+		max, min = other.Max, other.Min
+	} else if other.Num == 0 {
+		max, min = m.Max, m.Min
+	}
+
+	return Metric{
+		Max:    max,
+		Min:    min,
+		Num:    m.Num + other.Num,
+		Sum:    m.Sum + other.Sum,
+		SumSq:  m.SumSq + other.SumSq,
+		First:  firstPoint(m.First, other.First),
+		Last:   lastPoint(m.Last, other.Last),
+		Sketch: m.Sketch.merge(other.Sketch),
+		HLL:    m.HLL.merge(other.HLL),
+		Rate:   m.Rate + other.Rate,
+	}
 }
 
 // A Sample is a single aggregated sample in a time series.
 type Sample struct {
 	Start   time.Time
 	Metrics map[string]Metric
+
+	// Tags holds the values of the grouped tag keys if the samples have been
+	// grouped by tags.
+	Tags bson.M
 }
 
 // A TimeSeries is a list of samples.
@@ -73,6 +155,89 @@ func (ts *TimeSeries) Avg(metric string) float64 {
 	return ts.Sum(metric) / float64(ts.Num(metric))
 }
 
+// SumSq returns the sum of all squared measured values for the given time
+// series.
+func (ts *TimeSeries) SumSq(metric string) float64 {
+	var sum float64
+
+	for _, p := range ts.Samples {
+		sum += p.Metrics[metric].SumSq
+	}
+
+	return sum
+}
+
+// Variance returns the population variance of the measured values for the
+// given time series.
+func (ts *TimeSeries) Variance(metric string) float64 {
+	return variance(ts.Num(metric), ts.Sum(metric), ts.SumSq(metric))
+}
+
+// StdDev returns the population standard deviation of the measured values for
+// the given time series.
+func (ts *TimeSeries) StdDev(metric string) float64 {
+	return math.Sqrt(ts.Variance(metric))
+}
+
+// Quantile returns the approximate value at the specified quantile (0-1) for
+// the given time series. It requires that sketches have been enabled for the
+// metric.
+func (ts *TimeSeries) Quantile(metric string, q float64) float64 {
+	// merge all measured metrics
+	var merged Metric
+	var found bool
+	for _, p := range ts.Samples {
+		m := p.Metrics[metric]
+		if m.Num == 0 {
+			continue
+		}
+
+		if found {
+			merged = merged.merge(m)
+		} else {
+			merged = m
+			found = true
+		}
+	}
+
+	return merged.Quantile(q)
+}
+
+// Cardinality returns the estimated number of distinct values for the given
+// time series. It requires that the values have been inserted using
+// InsertDistinct.
+func (ts *TimeSeries) Cardinality(metric string) float64 {
+	var hll HyperLogLog
+
+	for _, p := range ts.Samples {
+		hll = hll.merge(p.Metrics[metric].HLL)
+	}
+
+	return hll.Estimate()
+}
+
+// First returns the earliest measured value for the given time series.
+func (ts *TimeSeries) First(metric string) Point {
+	var first Point
+
+	for _, p := range ts.Samples {
+		first = firstPoint(first, p.Metrics[metric].First)
+	}
+
+	return first
+}
+
+// Last returns the most recent measured value for the given time series.
+func (ts *TimeSeries) Last(metric string) Point {
+	var last Point
+
+	for _, p := range ts.Samples {
+		last = lastPoint(last, p.Metrics[metric].Last)
+	}
+
+	return last
+}
+
 // Null will return a new TimeSeries that includes samples for the specified
 // timestamps or a null value if no sample exists in the time series.
 func (ts *TimeSeries) Null(timestamps []time.Time, metrics []string) *TimeSeries {
@@ -122,3 +287,98 @@ func (ts *TimeSeries) Null(timestamps []time.Time, metrics []string) *TimeSeries
 
 	return &TimeSeries{samples}
 }
+
+func variance(num int64, sum, sumSq float64) float64 {
+	// check number
+	if num == 0 {
+		return 0
+	}
+
+	// calculate variance
+	mean := sum / float64(num)
+	v := sumSq/float64(num) - mean*mean
+
+	// ignore negative rounding errors
+	if v < 0 {
+		return 0
+	}
+
+	return v
+}
+
+func firstPoint(a, b Point) Point {
+	// ignore missing points
+	if a.Time.IsZero() {
+		return b
+	} else if b.Time.IsZero() {
+		return a
+	}
+
+	// pick earlier point
+	if b.before(a) {
+		return b
+	}
+
+	return a
+}
+
+func lastPoint(a, b Point) Point {
+	// ignore missing points
+	if a.Time.IsZero() {
+		return b
+	} else if b.Time.IsZero() {
+		return a
+	}
+
+	// pick later point
+	if a.before(b) {
+		return b
+	}
+
+	return a
+}
+
+// A Group is the time series of a single combination of grouped tag values.
+type Group struct {
+	Tags   bson.M
+	Series *TimeSeries
+}
+
+func groupSamples(samples []Sample) []Group {
+	// prepare groups
+	index := map[string]*Group{}
+	var keys []string
+
+	// add samples to groups
+	for _, sample := range samples {
+		// get tags
+		tags := sample.Tags
+		if tags == nil {
+			tags = bson.M{}
+		}
+
+		// get or add group
+		key := tagsKey(tags)
+		group, ok := index[key]
+		if !ok {
+			group = &Group{Tags: tags, Series: &TimeSeries{}}
+			index[key] = group
+			keys = append(keys, key)
+		}
+
+		// add sample without tags
+		sample.Tags = nil
+		group.Series.Samples = append(group.Series.Samples, sample)
+	}
+
+	// sort keys
+	sort.Strings(keys)
+
+	// collect groups
+	groups := make([]Group, 0, len(keys))
+	for _, key := range keys {
+		groups = append(groups, *index[key])
+	}
+
+	return groups
+}
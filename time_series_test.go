@@ -2,6 +2,7 @@ package mgots
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -149,3 +150,65 @@ func TestTimeSeriesNull3(t *testing.T) {
 		},
 	}, forceUTCTimeSeries(ts2))
 }
+
+func TestTimeSeriesVariance(t *testing.T) {
+	ts := &TimeSeries{
+		Samples: []Sample{
+			{
+				Start: parseTime("Jul 15 15:15:15"),
+				Metrics: map[string]Metric{
+					"value": {Max: 4, Min: 2, Num: 4, Sum: 14, SumSq: 52},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:15:16"),
+				Metrics: map[string]Metric{
+					"value": {Max: 9, Min: 5, Num: 4, Sum: 26, SumSq: 180},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, 0.75, ts.Samples[0].Metrics["value"].Variance())
+	assert.Equal(t, 2.75, ts.Samples[1].Metrics["value"].Variance())
+	assert.Equal(t, float64(4), ts.Variance("value"))
+	assert.Equal(t, float64(2), ts.StdDev("value"))
+	assert.Equal(t, float64(0), ts.Variance("missing"))
+}
+
+func TestTimeSeriesFirstLast(t *testing.T) {
+	ts := &TimeSeries{
+		Samples: []Sample{
+			{
+				Start: parseTime("Jul 15 15:15:15"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 4, Min: 2, Num: 2, Sum: 6,
+						First: Point{Time: parseTime("Jul 15 15:15:15"), Value: 4},
+						Last:  Point{Time: parseTime("Jul 15 15:15:15").Add(time.Millisecond), Value: 2},
+					},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:15:16"),
+				Metrics: map[string]Metric{
+					"value": {},
+				},
+			},
+			{
+				Start: parseTime("Jul 15 15:15:17"),
+				Metrics: map[string]Metric{
+					"value": {
+						Max: 9, Min: 9, Num: 1, Sum: 9,
+						First: Point{Time: parseTime("Jul 15 15:15:17"), Value: 9},
+						Last:  Point{Time: parseTime("Jul 15 15:15:17"), Value: 9},
+					},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, Point{Time: parseTime("Jul 15 15:15:15"), Value: 4}, ts.First("value"))
+	assert.Equal(t, Point{Time: parseTime("Jul 15 15:15:17"), Value: 9}, ts.Last("value"))
+	assert.Equal(t, Point{}, ts.Last("missing"))
+}
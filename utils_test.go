@@ -1,19 +1,25 @@
 package mgots
 
 import (
+	"context"
+	"testing"
 	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var db *mgo.Database
 
+var driverDB *mongo.Database
+
 func init() {
-	// create session
-	sess, err := mgo.Dial("mongodb://localhost/test-mgots")
+	// create session and skip MongoDB tests if no server is reachable
+	sess, err := mgo.DialWithTimeout("mongodb://localhost/test-mgots", 2*time.Second)
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	// save db reference
@@ -30,6 +36,21 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	// create driver client
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost"))
+	if err != nil {
+		panic(err)
+	}
+
+	// save driver db reference
+	driverDB = client.Database("test-mgots")
+}
+
+func requireMongo(tb testing.TB) {
+	if db == nil {
+		tb.Skip("MongoDB is not available")
+	}
 }
 
 func parseTime(str string) time.Time {
@@ -69,8 +90,25 @@ func forceUTCTimeSeries(ts *TimeSeries) *TimeSeries {
 	for i, s := range ts.Samples {
 		ss := s
 		ss.Start = ss.Start.UTC()
+		for name, m := range ss.Metrics {
+			m.First.Time = m.First.Time.UTC()
+			m.Last.Time = m.Last.Time.UTC()
+			ss.Metrics[name] = m
+		}
 		ts.Samples[i] = ss
 	}
 
 	return ts
 }
+
+func eventually(t *testing.T, fn func() bool) {
+	for i := 0; i < 1000; i++ {
+		if fn() {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Error("condition not met in time")
+}
@@ -0,0 +1,210 @@
+package mgots
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrWriterClosed is returned when a closed writer is used.
+var ErrWriterClosed = errors.New("mgots: writer closed")
+
+type writerJob struct {
+	bulk   *Bulk
+	result chan error
+}
+
+// A Writer buffers inserts from many goroutines and writes them to the
+// collection asynchronously using bulk operations.
+type Writer struct {
+	coll     *Collection
+	size     int
+	interval time.Duration
+	reporter func(error)
+
+	bulk  *Bulk
+	num   int
+	mutex sync.Mutex
+
+	closed  bool
+	closing sync.RWMutex
+
+	queue chan writerJob
+	done  chan struct{}
+}
+
+// NewWriter will return a new writer that flushes the buffered inserts when
+// size inserts have been buffered or the interval has passed since the last
+// flush. A zero size or interval disables the respective flush. Errors from
+// asynchronous flushes are passed to the reporter if available.
+func NewWriter(coll *Collection, size int, interval time.Duration, reporter func(error)) *Writer {
+	// prepare writer
+	w := &Writer{
+		coll:     coll,
+		size:     size,
+		interval: interval,
+		reporter: reporter,
+		bulk:     coll.Bulk(),
+		queue:    make(chan writerJob, 1),
+		done:     make(chan struct{}),
+	}
+
+	// run flusher
+	go w.run()
+
+	return w
+}
+
+// Insert will buffer the insert of the specified metrics. It will only block
+// if the flushes cannot keep up with the inserts.
+func (w *Writer) Insert(timestamp time.Time, metrics map[string]float64, tags bson.M) error {
+	// acquire read lock
+	w.closing.RLock()
+	defer w.closing.RUnlock()
+
+	// check if closed
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	// acquire mutex
+	w.mutex.Lock()
+
+	// add insert
+	w.bulk.Insert(timestamp, metrics, tags)
+	w.num++
+
+	// swap bulk if full
+	var bulk *Bulk
+	if w.size > 0 && w.num >= w.size {
+		bulk = w.swap()
+	}
+
+	// release mutex
+	w.mutex.Unlock()
+
+	// queue full bulk
+	if bulk != nil {
+		w.queue <- writerJob{bulk: bulk}
+	}
+
+	return nil
+}
+
+// Flush will write all buffered inserts and wait until they and all
+// previously queued flushes have completed. It will return the error of the
+// last flush.
+func (w *Writer) Flush() error {
+	// acquire read lock
+	w.closing.RLock()
+	defer w.closing.RUnlock()
+
+	// check if closed
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	return w.flush()
+}
+
+// Close will flush all buffered inserts and stop the writer. It will return
+// the error of the last flush.
+func (w *Writer) Close() error {
+	// acquire write lock
+	w.closing.Lock()
+	defer w.closing.Unlock()
+
+	// check if closed
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	// set flag
+	w.closed = true
+
+	// flush remaining inserts
+	err := w.flush()
+
+	// stop flusher
+	close(w.queue)
+	<-w.done
+
+	return err
+}
+
+func (w *Writer) flush() error {
+	// get current bulk
+	w.mutex.Lock()
+	bulk := w.swap()
+	w.mutex.Unlock()
+
+	// queue job
+	result := make(chan error, 1)
+	w.queue <- writerJob{bulk: bulk, result: result}
+
+	return <-result
+}
+
+func (w *Writer) swap() *Bulk {
+	// replace bulk
+	bulk := w.bulk
+	w.bulk = w.coll.Bulk()
+	w.num = 0
+
+	return bulk
+}
+
+func (w *Writer) run() {
+	// signal when done
+	defer close(w.done)
+
+	// prepare ticker
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case job, ok := <-w.queue:
+			// check if closed
+			if !ok {
+				return
+			}
+
+			// run bulk
+			err := job.bulk.Run()
+
+			// return or report error
+			if job.result != nil {
+				job.result <- err
+			} else {
+				w.report(err)
+			}
+		case <-tick:
+			// get current bulk if not empty
+			var bulk *Bulk
+			w.mutex.Lock()
+			if w.num > 0 {
+				bulk = w.swap()
+			}
+			w.mutex.Unlock()
+
+			// run bulk
+			if bulk != nil {
+				w.report(bulk.Run())
+			}
+		}
+	}
+}
+
+func (w *Writer) report(err error) {
+	// report error if available
+	if err != nil && w.reporter != nil {
+		w.reporter(err)
+	}
+}
@@ -0,0 +1,122 @@
+package mgots
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingBackend struct {
+	*MemoryBackend
+}
+
+func (b *failingBackend) Upsert(ctx context.Context, upserts []Upsert) error {
+	if len(upserts) == 0 {
+		return nil
+	}
+
+	return errors.New("failed")
+}
+
+func TestWriterSize(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	w := NewWriter(tsc, 10, 0, nil)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	for i := 0; i < 25; i++ {
+		err := w.Insert(now, map[string]float64{
+			"value": float64(i),
+		}, nil)
+		assert.NoError(t, err)
+	}
+
+	eventually(t, func() bool {
+		ts, err := tsc.AggregateSets(now, now, []string{"value"}, nil)
+		assert.NoError(t, err)
+		return len(ts.Samples) == 1 && ts.Num("value") == 20
+	})
+
+	assert.NoError(t, w.Close())
+
+	ts, err := tsc.AggregateSets(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(25), ts.Num("value"))
+	assert.Equal(t, float64(300), ts.Sum("value"))
+}
+
+func TestWriterInterval(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	w := NewWriter(tsc, 0, 10*time.Millisecond, nil)
+	defer w.Close()
+
+	now := parseTime("Jul 15 15:15:15")
+
+	err := w.Insert(now, map[string]float64{
+		"value": 1,
+	}, nil)
+	assert.NoError(t, err)
+
+	eventually(t, func() bool {
+		ts, err := tsc.AggregateSets(now, now, []string{"value"}, nil)
+		assert.NoError(t, err)
+		return len(ts.Samples) == 1
+	})
+}
+
+func TestWriterFlush(t *testing.T) {
+	tsc := WrapBackend(NewMemoryBackend(), OneMinuteOf60Seconds)
+	w := NewWriter(tsc, 0, 0, nil)
+
+	now := parseTime("Jul 15 15:15:15")
+
+	err := w.Insert(now, map[string]float64{
+		"value": 1,
+	}, nil)
+	assert.NoError(t, err)
+
+	ts, err := tsc.AggregateSets(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 0)
+
+	assert.NoError(t, w.Flush())
+
+	ts, err = tsc.AggregateSets(now, now, []string{"value"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, ts.Samples, 1)
+
+	assert.NoError(t, w.Close())
+	assert.Equal(t, ErrWriterClosed, w.Close())
+	assert.Equal(t, ErrWriterClosed, w.Flush())
+	assert.Equal(t, ErrWriterClosed, w.Insert(now, map[string]float64{
+		"value": 1,
+	}, nil))
+}
+
+func TestWriterErrors(t *testing.T) {
+	tsc := WrapBackend(&failingBackend{NewMemoryBackend()}, OneMinuteOf60Seconds)
+
+	errs := make(chan error, 1)
+	w := NewWriter(tsc, 1, 0, func(err error) {
+		errs <- err
+	})
+
+	now := parseTime("Jul 15 15:15:15")
+
+	err := w.Insert(now, map[string]float64{
+		"value": 1,
+	}, nil)
+	assert.NoError(t, err)
+	assert.EqualError(t, <-errs, "failed")
+
+	err = w.Insert(now, map[string]float64{
+		"value": 1,
+	}, nil)
+	assert.NoError(t, err)
+	assert.EqualError(t, <-errs, "failed")
+
+	assert.NoError(t, w.Close())
+}